@@ -0,0 +1,295 @@
+package fees
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+)
+
+// Scopes limit the operations an API key can perform, admin keys can perform all of them
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeClose = "close"
+	ScopeAdmin = "admin"
+)
+
+var apiKeyScopes = []string{ScopeRead, ScopeWrite, ScopeClose, ScopeAdmin}
+
+// apiKeyPrefix marks the keys issued by the service, so leaked keys are easy to recognise
+const apiKeyPrefix = "fk_"
+
+var errApiKeyNotFound = errors.New("api key not found")
+
+// AuthData identifies the API key a request was made with
+type AuthData struct {
+	KeyId    string
+	TenantId string
+	Scopes   []string
+	Role     string
+}
+
+// scoped reports whether any scope of the key allows the operation
+func (d *AuthData) scoped(op operation) bool {
+	for _, scope := range d.Scopes {
+		if grants(scopeOperations[scope], op) {
+			return true
+		}
+	}
+	return false
+}
+
+type ApiKey struct {
+	Id        string     `json:"id"`
+	TenantId  string     `json:"tenantId"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // first characters of the key, to tell keys apart
+	Scopes    []string   `json:"scopes"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	KeyHash   string     `json:"-"`
+}
+
+type CreateApiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"` // read, write, close, admin
+	Role   string   `json:"role"`   // viewer, biller, approver, admin
+}
+
+// CreateTenantApiKeyRequest issues the first key of a tenant
+type CreateTenantApiKeyRequest struct {
+	TenantId string   `json:"tenantId"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Role     string   `json:"role"`
+}
+
+type CreateApiKeyResponse struct {
+	ApiKey ApiKey `json:"apiKey"`
+	Key    string `json:"key"` // only returned when the key is created, it cannot be retrieved later
+}
+
+type GetApiKeysResponse struct {
+	ApiKeys []ApiKey `json:"apiKeys"`
+}
+
+type RevokeApiKeyRequest struct {
+	Id string `json:"id"`
+}
+
+// AuthHandler authenticates requests with an API key sent as a bearer token.
+// encore:authhandler
+func (s *Service) AuthHandler(ctx context.Context, token string) (auth.UID, *AuthData, error) {
+	key, err := s.apiKeys.GetApiKeyByHash(ctx, hashApiKey(token))
+	if errors.Is(err, errApiKeyNotFound) {
+		return "", nil, s.eb.Code(errs.Unauthenticated).Msg("invalid api key").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading api key", "error", err)
+		return "", nil, s.eb.Code(errs.Internal).Msg("unable to authenticate").Err()
+	}
+	if key.RevokedAt != nil {
+		rlog.Warn("Revoked api key used", "id", key.Id, "tenant", key.TenantId)
+		return "", nil, s.eb.Code(errs.Unauthenticated).Msg("invalid api key").Err()
+	}
+
+	return auth.UID(key.Id), &AuthData{KeyId: key.Id, TenantId: key.TenantId, Scopes: key.Scopes, Role: key.Role}, nil
+}
+
+// encore:api auth method=POST path=/api/key
+func (s *Service) CreateApiKey(ctx context.Context, req *CreateApiKeyRequest) (*CreateApiKeyResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueApiKey(ctx, tenant.Id, req.Name, req.Scopes, req.Role)
+}
+
+// CreateTenantApiKey issues a key for any tenant, it is how the first admin key of a tenant is created.
+// encore:api private method=POST path=/api/tenant/key
+func (s *Service) CreateTenantApiKey(ctx context.Context, req *CreateTenantApiKeyRequest) (*CreateApiKeyResponse, error) {
+	if _, err := s.GetTenant(ctx, req.TenantId); err != nil {
+		return nil, err
+	}
+	return s.issueApiKey(ctx, req.TenantId, req.Name, req.Scopes, req.Role)
+}
+
+// encore:api auth method=GET path=/api/keys
+func (s *Service) GetApiKeys(ctx context.Context) (*GetApiKeysResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.apiKeys.ListApiKeys(ctx, tenant.Id)
+	if err != nil {
+		rlog.Error("Error listing api keys", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get api keys").Err()
+	}
+	return &GetApiKeysResponse{ApiKeys: keys}, nil
+}
+
+// RevokeApiKey stops the key from authenticating, revoking a key twice keeps the first revocation time.
+// encore:api auth method=POST path=/api/key/revoke
+func (s *Service) RevokeApiKey(ctx context.Context, req *RevokeApiKeyRequest) (*ApiKey, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Revoking api key", "id", req.Id, "tenant", tenant.Id)
+
+	key, err := s.apiKeys.RevokeApiKey(ctx, tenant.Id, req.Id)
+	if errors.Is(err, errApiKeyNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("api key not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error revoking api key", "id", req.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to revoke api key").Err()
+	}
+	return key, nil
+}
+
+func (s *Service) issueApiKey(ctx context.Context, tenantId string, name string, scopes []string, role string) (*CreateApiKeyResponse, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("name is required").Err()
+	}
+	if len(scopes) == 0 {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("at least one scope is required").Err()
+	}
+	for _, scope := range scopes {
+		if !contains(apiKeyScopes, scope) {
+			return nil, s.eb.Code(errs.InvalidArgument).Msgf("invalid scope %s, use read, write, close or admin", scope).Err()
+		}
+	}
+
+	if !contains(roles, role) {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid role, use viewer, biller, approver or admin").Err()
+	}
+
+	secret, err := generateApiKey()
+	if err != nil {
+		rlog.Error("Error generating api key", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create api key").Err()
+	}
+
+	key := ApiKey{
+		Id:       uuid.New().String(),
+		TenantId: tenantId,
+		Name:     name,
+		Prefix:   secret[:len(apiKeyPrefix)+6],
+		Scopes:   scopes,
+		Role:     role,
+		KeyHash:  hashApiKey(secret),
+	}
+
+	rlog.Info("Creating api key", "id", key.Id, "tenant", tenantId, "scopes", scopes, "role", role)
+
+	created, err := s.apiKeys.CreateApiKey(ctx, key)
+	if err != nil {
+		rlog.Error("Error creating api key", "id", key.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create api key").Err()
+	}
+	return &CreateApiKeyResponse{ApiKey: *created, Key: secret}, nil
+}
+
+func generateApiKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashApiKey hashes the key for storage, keys are random so they need no salt or slow hash
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyRepository stores the API keys by their hash, the keys themselves are never stored
+type apiKeyRepository interface {
+	CreateApiKey(ctx context.Context, key ApiKey) (*ApiKey, error)
+	GetApiKeyByHash(ctx context.Context, hash string) (*ApiKey, error)
+	// ListApiKeys returns the keys of the tenant, revoked keys included, newest first
+	ListApiKeys(ctx context.Context, tenantId string) ([]ApiKey, error)
+	RevokeApiKey(ctx context.Context, tenantId string, id string) (*ApiKey, error)
+}
+
+type apiKeyStore struct {
+	db *sqldb.Database
+}
+
+const apiKeyColumns = `id, tenant_id, name, prefix, key_hash, scopes, role, created_at, revoked_at`
+
+func (s *apiKeyStore) CreateApiKey(ctx context.Context, key ApiKey) (*ApiKey, error) {
+	row := s.db.QueryRow(ctx, `
+		INSERT INTO api_keys (id, tenant_id, name, prefix, key_hash, scopes, role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+apiKeyColumns,
+		key.Id, key.TenantId, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.Role)
+	return scanApiKey(row)
+}
+
+func (s *apiKeyStore) GetApiKeyByHash(ctx context.Context, hash string) (*ApiKey, error) {
+	row := s.db.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1`, hash)
+	return scanApiKey(row)
+}
+
+func (s *apiKeyStore) ListApiKeys(ctx context.Context, tenantId string) ([]ApiKey, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE tenant_id = $1
+		ORDER BY created_at DESC, id`,
+		tenantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]ApiKey, 0)
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *apiKeyStore) RevokeApiKey(ctx context.Context, tenantId string, id string) (*ApiKey, error) {
+	row := s.db.QueryRow(ctx, `
+		UPDATE api_keys
+		SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING `+apiKeyColumns,
+		id, tenantId)
+	return scanApiKey(row)
+}
+
+func scanApiKey(row interface{ Scan(dest ...interface{}) error }) (*ApiKey, error) {
+	var key ApiKey
+	err := row.Scan(&key.Id, &key.TenantId, &key.Name, &key.Prefix, &key.KeyHash, &key.Scopes, &key.Role, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errApiKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
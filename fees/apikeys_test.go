@@ -0,0 +1,246 @@
+package fees
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/mocks"
+)
+
+type fakeApiKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]ApiKey
+}
+
+func newFakeApiKeyStore() *fakeApiKeyStore {
+	return &fakeApiKeyStore{keys: make(map[string]ApiKey)}
+}
+
+func (f *fakeApiKeyStore) CreateApiKey(ctx context.Context, key ApiKey) (*ApiKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key.CreatedAt = time.Now()
+	f.keys[key.Id] = key
+	return &key, nil
+}
+
+func (f *fakeApiKeyStore) GetApiKeyByHash(ctx context.Context, hash string) (*ApiKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range f.keys {
+		if key.KeyHash == hash {
+			return &key, nil
+		}
+	}
+	return nil, errApiKeyNotFound
+}
+
+func (f *fakeApiKeyStore) ListApiKeys(ctx context.Context, tenantId string) ([]ApiKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]ApiKey, 0)
+	for _, key := range f.keys {
+		if key.TenantId == tenantId {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (f *fakeApiKeyStore) RevokeApiKey(ctx context.Context, tenantId string, id string) (*ApiKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[id]
+	if !ok || key.TenantId != tenantId {
+		return nil, errApiKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+	}
+	f.keys[id] = key
+	return &key, nil
+}
+
+func (s *UnitTestSuite) apiKeyService() *Service {
+	return &Service{
+		client:  mocks.NewClient(s.T()),
+		worker:  nil,
+		tenants: newFakeTenantStore(testTenant, otherTenant),
+		apiKeys: newFakeApiKeyStore(),
+		eb:      *errs.B(),
+	}
+}
+
+func (s *UnitTestSuite) Test_CreateApiKey() {
+	service := s.apiKeyService()
+	ctx := tenantContext(testTenant)
+
+	resp, err := service.CreateApiKey(ctx, &CreateApiKeyRequest{Name: " ci ", Scopes: []string{ScopeRead}, Role: RoleViewer})
+	s.NoError(err)
+	s.True(strings.HasPrefix(resp.Key, apiKeyPrefix))
+	s.True(strings.HasPrefix(resp.Key, resp.ApiKey.Prefix))
+	s.Equal("ci", resp.ApiKey.Name)
+	s.Equal(testTenant.Id, resp.ApiKey.TenantId)
+
+	// Only the hash of the key is stored
+	keys, err := service.GetApiKeys(ctx)
+	s.NoError(err)
+	s.Len(keys.ApiKeys, 1)
+	s.Equal(hashApiKey(resp.Key), keys.ApiKeys[0].KeyHash)
+	s.NotContains(keys.ApiKeys[0].KeyHash, resp.Key)
+
+	keys, err = service.GetApiKeys(tenantContext(otherTenant))
+	s.NoError(err)
+	s.Empty(keys.ApiKeys)
+
+	_, err = service.CreateApiKey(ctx, &CreateApiKeyRequest{Name: "ci", Role: RoleViewer})
+	s.EqualError(err, "invalid_argument: at least one scope is required")
+
+	_, err = service.CreateApiKey(ctx, &CreateApiKeyRequest{Name: "ci", Scopes: []string{"delete"}, Role: RoleViewer})
+	s.EqualError(err, "invalid_argument: invalid scope delete, use read, write, close or admin")
+
+	_, err = service.CreateApiKey(ctx, &CreateApiKeyRequest{Scopes: []string{ScopeRead}, Role: RoleViewer})
+	s.EqualError(err, "invalid_argument: name is required")
+
+	_, err = service.CreateApiKey(ctx, &CreateApiKeyRequest{Name: "ci", Scopes: []string{ScopeRead}, Role: "owner"})
+	s.EqualError(err, "invalid_argument: invalid role, use viewer, biller, approver or admin")
+
+	_, err = service.CreateTenantApiKey(context.Background(), &CreateTenantApiKeyRequest{TenantId: "unknown", Name: "admin", Scopes: []string{ScopeAdmin}, Role: RoleAdmin})
+	s.EqualError(err, "not_found: tenant not found")
+}
+
+func (s *UnitTestSuite) Test_AuthHandler() {
+	service := s.apiKeyService()
+	ctx := context.Background()
+
+	created, err := service.CreateTenantApiKey(ctx, &CreateTenantApiKeyRequest{TenantId: otherTenant.Id, Name: "billing", Scopes: []string{ScopeRead, ScopeClose}, Role: RoleApprover})
+	s.NoError(err)
+
+	uid, data, err := service.AuthHandler(ctx, created.Key)
+	s.NoError(err)
+	s.Equal(created.ApiKey.Id, string(uid))
+	s.Equal(otherTenant.Id, data.TenantId)
+	s.Equal([]string{ScopeRead, ScopeClose}, data.Scopes)
+	s.Equal(RoleApprover, data.Role)
+
+	_, _, err = service.AuthHandler(ctx, apiKeyPrefix+"unknown")
+	s.EqualError(err, "unauthenticated: invalid api key")
+
+	// Revoked keys stop authenticating, keys of other tenants cannot be revoked
+	_, err = service.RevokeApiKey(tenantContext(testTenant), &RevokeApiKeyRequest{Id: created.ApiKey.Id})
+	s.EqualError(err, "not_found: api key not found")
+
+	revoked, err := service.RevokeApiKey(tenantContext(otherTenant), &RevokeApiKeyRequest{Id: created.ApiKey.Id})
+	s.NoError(err)
+	s.NotNil(revoked.RevokedAt)
+
+	_, _, err = service.AuthHandler(ctx, created.Key)
+	s.EqualError(err, "unauthenticated: invalid api key")
+}
+
+func (s *UnitTestSuite) Test_Authorize() {
+	service := s.apiKeyService()
+	ctx := context.Background()
+
+	reader := &AuthData{KeyId: "1", TenantId: otherTenant.Id, Scopes: []string{ScopeRead}, Role: RoleAdmin}
+	tenant, err := service.authorize(ctx, "GetBills", reader)
+	s.NoError(err)
+	s.Equal(otherTenant.Id, tenant.Id)
+
+	_, err = service.authorize(ctx, "CloseBill", reader)
+	s.EqualError(err, "permission_denied: api key is not scoped to close bills")
+
+	_, err = service.authorize(ctx, "CreateApiKey", &AuthData{KeyId: "2", TenantId: otherTenant.Id, Scopes: []string{ScopeWrite, ScopeClose}, Role: RoleAdmin})
+	s.EqualError(err, "permission_denied: api key is not scoped to manage keys")
+
+	// Admin keys with the admin role can call every endpoint
+	admin := &AuthData{KeyId: "3", TenantId: otherTenant.Id, Scopes: []string{ScopeAdmin}, Role: RoleAdmin}
+	for endpoint := range endpointOperations {
+		_, err = service.authorize(ctx, endpoint, admin)
+		s.NoError(err, endpoint)
+	}
+
+	_, err = service.authorize(ctx, "NewEndpoint", admin)
+	s.EqualError(err, "permission_denied: endpoint is not available to api keys")
+
+	_, err = service.authorize(ctx, "GetBills", nil)
+	s.EqualError(err, "unauthenticated: an api key is required")
+
+	_, err = service.authorize(ctx, "GetBills", &AuthData{KeyId: "4", TenantId: "deleted", Scopes: []string{ScopeRead}, Role: RoleViewer})
+	s.EqualError(err, "permission_denied: unknown tenant")
+}
+
+func (s *UnitTestSuite) Test_Authorize_Roles() {
+	service := s.apiKeyService()
+	ctx := context.Background()
+
+	// Keys with every scope are limited by their role
+	key := func(role string) *AuthData {
+		return &AuthData{KeyId: role, TenantId: testTenant.Id, Scopes: []string{ScopeAdmin}, Role: role}
+	}
+
+	allowed := map[string][]string{
+		RoleViewer:   {"GetBill", "GetBills"},
+		RoleBiller:   {"GetBill", "CreateBill", "AddLineItem", "CreateCustomer", "PauseSubscription"},
+		RoleApprover: {"GetBill", "VoidLineItem", "CloseBill"},
+		RoleAdmin:    {"AddLineItem", "VoidLineItem", "CloseBill", "CreateApiKey", "RebuildBills"},
+	}
+	for role, endpoints := range allowed {
+		for _, endpoint := range endpoints {
+			_, err := service.authorize(ctx, endpoint, key(role))
+			s.NoError(err, role+" "+endpoint)
+		}
+	}
+
+	_, err := service.authorize(ctx, "AddLineItem", key(RoleViewer))
+	s.EqualError(err, "permission_denied: the viewer role cannot add items")
+
+	_, err = service.authorize(ctx, "CloseBill", key(RoleBiller))
+	s.EqualError(err, "permission_denied: the biller role cannot close bills")
+
+	_, err = service.authorize(ctx, "VoidLineItem", key(RoleBiller))
+	s.EqualError(err, "permission_denied: the biller role cannot void items")
+
+	_, err = service.authorize(ctx, "AddLineItem", key(RoleApprover))
+	s.EqualError(err, "permission_denied: the approver role cannot add items")
+
+	_, err = service.authorize(ctx, "CreateApiKey", key(RoleApprover))
+	s.EqualError(err, "permission_denied: the approver role cannot manage keys")
+}
+
+// Every authenticated endpoint must have an operation, or api keys cannot call it
+func (s *UnitTestSuite) Test_EndpointOperations_CoverEndpoints() {
+	endpoint := regexp.MustCompile(`// encore:api (auth|private) .*\nfunc \(s \*Service\) (\w+)\(`)
+
+	files, err := filepath.Glob("*.go")
+	s.NoError(err)
+
+	found := 0
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		s.NoError(err)
+		for _, match := range endpoint.FindAllSubmatch(src, -1) {
+			found++
+			name := string(match[2])
+			// Private endpoints cannot be called with a key, so they must not need one
+			if string(match[1]) == "private" {
+				s.True(tenantlessEndpoints[name], "%s in %s is private but needs a key", name, file)
+				continue
+			}
+			s.Contains(endpointOperations, name, file)
+		}
+	}
+	s.Greater(found, 0)
+}
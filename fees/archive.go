@@ -0,0 +1,118 @@
+package fees
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"encore.app/fees/workflow"
+	"go.temporal.io/sdk/temporal"
+)
+
+// billArchive holds closed bills as immutable JSON documents, written by the ArchiveBill activity
+type billArchive interface {
+	workflow.BillArchive
+	GetArchivedBill(ctx context.Context, id string) (*workflow.Bill, error)
+}
+
+// diskArchive keeps the archive on local disk, one file per bill
+type diskArchive struct {
+	dir string
+}
+
+// newDiskArchive archives into BILL_ARCHIVE_DIR, or ./archive/bills when it is not set
+func newDiskArchive() (*diskArchive, error) {
+	dir := os.Getenv("BILL_ARCHIVE_DIR")
+	if dir == "" {
+		dir = filepath.Join("archive", "bills")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &diskArchive{dir: dir}, nil
+}
+
+// plainId matches bill IDs that are safe to use as a file name as they are
+var plainId = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// fileName maps the bill ID to the name of its archive file. Other IDs, such as those of bills started
+// by subscription schedules which end in a timestamp, are named by their hash so they cannot escape the directory.
+func fileName(id string) string {
+	if plainId.MatchString(id) {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return "sha256-" + hex.EncodeToString(sum[:])
+}
+
+func (a *diskArchive) path(id string) string {
+	return filepath.Join(a.dir, fileName(id)+".json")
+}
+
+// ArchiveBill writes the bill once, an archived bill is never overwritten.
+// Bills that can never be archived fail without retrying the activity.
+func (a *diskArchive) ArchiveBill(ctx context.Context, bill workflow.Bill) error {
+	if bill.Id == "" {
+		return temporal.NewNonRetryableApplicationError("bill id is required", "InvalidBill", nil)
+	}
+	if bill.ClosedOn == nil {
+		return temporal.NewNonRetryableApplicationError("only closed bills can be archived", "InvalidBill", nil)
+	}
+	path := a.path(bill.Id)
+
+	data, err := json.Marshal(bill)
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file and linked into place, so readers never see a partial document
+	tmp, err := os.CreateTemp(a.dir, fileName(bill.Id)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// The activity is retried, the bill may already have been archived by an earlier attempt
+	err = os.Link(tmp.Name(), path)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (a *diskArchive) GetArchivedBill(ctx context.Context, id string) (*workflow.Bill, error) {
+	data, err := os.ReadFile(a.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBillNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bill workflow.Bill
+	if err := json.Unmarshal(data, &bill); err != nil {
+		return nil, err
+	}
+	// Guards against two IDs sharing a hashed name
+	if bill.Id != id {
+		return nil, errBillNotFound
+	}
+	return &bill, nil
+}
@@ -0,0 +1,100 @@
+package fees
+
+import (
+	"os"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/temporal"
+)
+
+func (s *UnitTestSuite) Test_DiskArchive_WritesOnce() {
+	archive := &diskArchive{dir: s.T().TempDir()}
+	ctx := tenantContext(testTenant)
+
+	closed := time.Now()
+	s.NoError(archive.ArchiveBill(ctx, workflow.Bill{Id: "1234", Currency: "USD", TotalAmount: 10.0, ClosedOn: &closed}))
+
+	// A retried activity leaves the archived bill as it was
+	s.NoError(archive.ArchiveBill(ctx, workflow.Bill{Id: "1234", Currency: "USD", TotalAmount: 20.0, ClosedOn: &closed}))
+
+	bill, err := archive.GetArchivedBill(ctx, "1234")
+	s.NoError(err)
+	s.Equal(10.0, bill.TotalAmount)
+
+	_, err = archive.GetArchivedBill(ctx, "5678")
+	s.ErrorIs(err, errBillNotFound)
+}
+
+func (s *UnitTestSuite) Test_DiskArchive_RejectsInvalidBills() {
+	archive := &diskArchive{dir: s.T().TempDir()}
+	ctx := tenantContext(testTenant)
+
+	// Retrying would never succeed, so the activity is not retried
+	var appErr *temporal.ApplicationError
+	err := archive.ArchiveBill(ctx, workflow.Bill{Id: "1234"})
+	s.ErrorAs(err, &appErr)
+	s.True(appErr.NonRetryable())
+	s.Equal("only closed bills can be archived", appErr.Message())
+
+	closed := time.Now()
+	err = archive.ArchiveBill(ctx, workflow.Bill{ClosedOn: &closed})
+	s.ErrorAs(err, &appErr)
+	s.True(appErr.NonRetryable())
+}
+
+func (s *UnitTestSuite) Test_DiskArchive_ScheduledBillIds() {
+	dir := s.T().TempDir()
+	archive := &diskArchive{dir: dir}
+	ctx := tenantContext(testTenant)
+
+	// Schedules append the time the bill was started to its ID
+	closed := time.Now()
+	id := "subscription-1234-2024-09-01T00:00:00Z"
+	s.NoError(archive.ArchiveBill(ctx, workflow.Bill{Id: id, Currency: "USD", TotalAmount: 10.0, ClosedOn: &closed}))
+	s.NoError(archive.ArchiveBill(ctx, workflow.Bill{Id: "../1234", Currency: "USD", TotalAmount: 5.0, ClosedOn: &closed}))
+
+	bill, err := archive.GetArchivedBill(ctx, id)
+	s.NoError(err)
+	s.Equal(10.0, bill.TotalAmount)
+
+	// IDs that are not plain file names stay inside the archive directory
+	bill, err = archive.GetArchivedBill(ctx, "../1234")
+	s.NoError(err)
+	s.Equal(5.0, bill.TotalAmount)
+	files, err := os.ReadDir(dir)
+	s.NoError(err)
+	s.Len(files, 2)
+}
+
+func (s *UnitTestSuite) Test_GetBill_FromArchive() {
+	mockClient := mocks.NewClient(s.T())
+	archive := &diskArchive{dir: s.T().TempDir()}
+	service := &Service{
+		client:  mockClient,
+		worker:  nil,
+		store:   newFakeBillStore(),
+		archive: archive,
+		eb:      *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	closed := time.Now()
+	s.NoError(archive.ArchiveBill(ctx, workflow.Bill{Id: "1234", Currency: "GEL", TotalAmount: 42.0, ClosedOn: &closed}))
+
+	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, serviceerror.NewNotFound("workflow not found"))
+
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{})
+	s.NoError(err)
+	s.Equal("GEL", bill.Currency)
+	s.Equal(42.0, bill.TotalAmount)
+
+	bill, err = service.GetBill(ctx, "5678", &GetBillParams{})
+	s.EqualError(err, "not_found: bill not found")
+	s.Nil(bill)
+}
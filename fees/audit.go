@@ -0,0 +1,145 @@
+package fees
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// Headers set by the load balancer in front of the service, and by callers tracing their requests
+const (
+	forwardedForHeader = "X-Forwarded-For"
+	realIpHeader       = "X-Real-Ip"
+	requestIdHeader    = "X-Request-Id"
+)
+
+// GetAuditParams filters the changes made to the bills of the tenant
+type GetAuditParams struct {
+	Actor    string `query:"actor"` // principal, the id of the API key that made the change
+	BillId   string `query:"billId"`
+	From     string `query:"from"`     // RFC 3339, inclusive
+	To       string `query:"to"`       // RFC 3339, exclusive
+	PageSize int    `query:"pageSize"` // defaults to 50, at most 200
+	Cursor   string `query:"cursor"`   // nextCursor of the previous page
+}
+
+type GetAuditResponse struct {
+	Events     []workflow.BillEvent `json:"events"`     // in the order they happened
+	NextCursor string               `json:"nextCursor"` // empty on the last page
+}
+
+// GetAudit lists who changed the bills of the tenant, and when.
+// encore:api auth method=GET path=/api/audit
+func (s *Service) GetAudit(ctx context.Context, params *GetAuditParams) (*GetAuditResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := auditQuery{TenantId: tenant.Id, Actor: params.Actor, BillId: params.BillId}
+
+	err = s.parseTimes(timeParam{"from", params.From, &query.From}, timeParam{"to", params.To, &query.To})
+	if err != nil {
+		return nil, err
+	}
+	if query.From != nil && query.To != nil && !query.From.Before(*query.To) {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("from must be before to").Err()
+	}
+
+	var after auditCursor
+	pageSize, paged, err := s.parsePage(params.PageSize, params.Cursor, &after)
+	if err != nil {
+		return nil, err
+	}
+	query.Limit = pageSize + 1
+	if paged {
+		query.After = &after
+	}
+
+	events, err := s.store.ListAuditEvents(ctx, query)
+	if err != nil {
+		rlog.Error("Error listing audit events", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get audit events").Err()
+	}
+
+	events, more := trimPage(events, pageSize)
+	res := &GetAuditResponse{Events: events}
+	if more {
+		res.NextCursor = encodeCursor(nextAuditCursor(events[len(events)-1]))
+	}
+	return res, nil
+}
+
+// auditQuery selects the events of the tenant's bills, ordered by when they happened
+type auditQuery struct {
+	TenantId string
+	Actor    string
+	BillId   string
+	From     *time.Time // inclusive
+	To       *time.Time // exclusive
+	After    *auditCursor
+	Limit    int
+}
+
+// auditCursor is the position of an event in the audit order
+type auditCursor struct {
+	OccurredAt time.Time `json:"occurredAt"`
+	BillId     string    `json:"billId"`
+	Sequence   int       `json:"sequence"`
+}
+
+func nextAuditCursor(last workflow.BillEvent) auditCursor {
+	return auditCursor{OccurredAt: cursorTime(last.OccurredAt), BillId: last.BillId, Sequence: last.Sequence}
+}
+
+func (c auditCursor) complete() bool {
+	return c.BillId != ""
+}
+
+type actorContextKey struct{}
+
+func withActor(ctx context.Context, actor workflow.Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// actorOf returns who is making the request, it is set by TenantMiddleware
+func actorOf(ctx context.Context) workflow.Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(workflow.Actor)
+	return actor
+}
+
+// requestActor identifies the caller from the API key and the request headers
+func requestActor(req *encore.Request, key *AuthData) workflow.Actor {
+	actor := workflow.Actor{RequestId: req.Headers.Get(requestIdHeader)}
+	if key != nil {
+		actor.Principal = key.KeyId
+	}
+	actor.ClientIp = clientIp(req.Headers)
+
+	// Requests without an id of their own are identified by their trace
+	if actor.RequestId == "" && req.Trace != nil {
+		actor.RequestId = req.Trace.TraceID
+	}
+	return actor
+}
+
+// clientIp is the address the load balancer saw the request from, the last one in X-Forwarded-For.
+// Earlier addresses are sent by the client and cannot be trusted. The load balancer appends to X-Forwarded-For on
+// every request it forwards, so X-Real-Ip is only trusted alongside it, without it the client set X-Real-Ip.
+func clientIp(headers http.Header) string {
+	values := headers.Values(forwardedForHeader)
+	if len(values) == 0 {
+		return ""
+	}
+	forwarded := strings.Split(strings.Join(values, ","), ",")
+	if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+		return ip
+	}
+	return headers.Get(realIpHeader)
+}
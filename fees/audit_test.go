@@ -0,0 +1,180 @@
+package fees
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+// auditService has bills 1234 and 5678 of the test tenant changed by two keys, and bill 9999 of another tenant
+func (s *UnitTestSuite) auditService() (*Service, time.Time) {
+	at := time.Date(2024, 9, 1, 9, 0, 0, 0, time.UTC)
+	biller := &workflow.Actor{Principal: "biller", ClientIp: "203.0.113.7", RequestId: "req1"}
+	approver := &workflow.Actor{Principal: "approver", ClientIp: "203.0.113.8", RequestId: "req2"}
+	store := newFakeBillStore(
+		workflow.Bill{Id: "1234", Currency: "USD"},
+		workflow.Bill{Id: "5678", Currency: "USD"},
+		workflow.Bill{Id: "9999", Currency: "USD", TenantId: otherTenant.Id},
+	)
+
+	item := workflow.LineItem{Id: "a", Description: "Licence", Amount: 100.0, Type: workflow.LineItemFee}
+	s.NoError(store.AppendEvents(context.Background(), []workflow.BillEvent{
+		{BillId: "1234", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at, Actor: biller},
+		{BillId: "1234", Sequence: 1, Type: workflow.EventItemAdded, OccurredAt: at.Add(time.Hour), Item: &item, Actor: biller},
+		// Go keeps nanoseconds the database drops
+		{BillId: "1234", Sequence: 2, Type: workflow.EventClosed, OccurredAt: at.Add(3*time.Hour + 789*time.Nanosecond), Actor: approver},
+		{BillId: "5678", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at.Add(2 * time.Hour), Actor: biller},
+		{BillId: "9999", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at, Actor: biller},
+	}))
+
+	return &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}, at
+}
+
+// The time range and order are applied by the database, see Test_BillStore_ListAuditEvents
+func (s *UnitTestSuite) Test_GetAudit() {
+	service, at := s.auditService()
+	store := service.store.(*fakeBillStore)
+	ctx := tenantContext(testTenant)
+
+	// Events of other tenants are never listed
+	resp, err := service.GetAudit(ctx, &GetAuditParams{})
+	s.NoError(err)
+	s.Len(resp.Events, 4)
+	for _, event := range resp.Events {
+		s.NotEqual("9999", event.BillId)
+	}
+	s.Empty(resp.NextCursor)
+	s.Equal(testTenant.Id, store.auditQueries[0].TenantId)
+
+	resp, err = service.GetAudit(ctx, &GetAuditParams{Actor: "approver"})
+	s.NoError(err)
+	s.Len(resp.Events, 1)
+	s.Equal(workflow.EventClosed, resp.Events[0].Type)
+	s.Equal("203.0.113.8", resp.Events[0].Actor.ClientIp)
+
+	_, err = service.GetAudit(ctx, &GetAuditParams{
+		Actor: "biller",
+		From:  at.Add(30 * time.Minute).Format(time.RFC3339),
+		To:    at.Add(2 * time.Hour).Format(time.RFC3339),
+	})
+	s.NoError(err)
+	query := store.auditQueries[2]
+	s.Equal("biller", query.Actor)
+	s.True(query.From.Equal(at.Add(30 * time.Minute)))
+	s.True(query.To.Equal(at.Add(2 * time.Hour)))
+
+	resp, err = service.GetAudit(ctx, &GetAuditParams{BillId: "5678"})
+	s.NoError(err)
+	s.Len(resp.Events, 1)
+}
+
+func (s *UnitTestSuite) Test_GetAudit_Pagination() {
+	service, at := s.auditService()
+	store := service.store.(*fakeBillStore)
+	ctx := tenantContext(testTenant)
+
+	// One more event than the page holds is fetched to tell there is another page.
+	// The cursor holds the time of the last event as the database stored it.
+	page, err := service.GetAudit(ctx, &GetAuditParams{PageSize: 3})
+	s.NoError(err)
+	s.Equal(4, store.auditQueries[0].Limit)
+	s.Len(page.Events, 3)
+	s.Equal(workflow.EventClosed, page.Events[2].Type)
+	s.NotEmpty(page.NextCursor)
+
+	_, err = service.GetAudit(ctx, &GetAuditParams{PageSize: 3, Cursor: page.NextCursor})
+	s.NoError(err)
+	s.Equal(&auditCursor{OccurredAt: at.Add(3 * time.Hour), BillId: "1234", Sequence: 2}, store.auditQueries[1].After)
+
+	page, err = service.GetAudit(ctx, &GetAuditParams{PageSize: 4})
+	s.NoError(err)
+	s.Len(page.Events, 4)
+	s.Empty(page.NextCursor)
+}
+
+func (s *UnitTestSuite) Test_GetAudit_InvalidParams() {
+	service, at := s.auditService()
+	ctx := tenantContext(testTenant)
+
+	_, err := service.GetAudit(ctx, &GetAuditParams{From: "2024-09-01"})
+	s.EqualError(err, "invalid_argument: invalid from parameter, use an RFC 3339 timestamp")
+
+	_, err = service.GetAudit(ctx, &GetAuditParams{From: at.Format(time.RFC3339), To: at.Format(time.RFC3339)})
+	s.EqualError(err, "invalid_argument: from must be before to")
+
+	_, err = service.GetAudit(ctx, &GetAuditParams{Cursor: "not-a-cursor"})
+	s.EqualError(err, "invalid_argument: invalid cursor")
+}
+
+func (s *UnitTestSuite) Test_RequestActor() {
+	req := &encore.Request{
+		Headers: http.Header{
+			"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"},
+			"X-Request-Id":    {"req1"},
+		},
+		Trace: &encore.TraceData{TraceID: "trace1"},
+	}
+	actor := requestActor(req, &AuthData{KeyId: "key1"})
+	s.Equal(workflow.Actor{Principal: "key1", ClientIp: "203.0.113.7", RequestId: "req1"}, actor)
+
+	// An address forged by the client comes before the one the load balancer appended
+	req = &encore.Request{
+		Headers: http.Header{"X-Forwarded-For": {"10.0.0.1", "203.0.113.8"}},
+	}
+	actor = requestActor(req, &AuthData{KeyId: "key1"})
+	s.Equal("203.0.113.8", actor.ClientIp)
+
+	// The real IP is only trusted on requests forwarded by the load balancer
+	req = &encore.Request{
+		Headers: http.Header{"X-Forwarded-For": {"198.51.100.1, "}, "X-Real-Ip": {"203.0.113.9"}},
+	}
+	actor = requestActor(req, &AuthData{KeyId: "key1"})
+	s.Equal("203.0.113.9", actor.ClientIp)
+
+	// Requests that did not come through the load balancer have no trusted address, and fall back to the trace
+	req = &encore.Request{
+		Headers: http.Header{"X-Real-Ip": {"203.0.113.9"}},
+		Trace:   &encore.TraceData{TraceID: "trace1"},
+	}
+	actor = requestActor(req, &AuthData{KeyId: "key1"})
+	s.Equal(workflow.Actor{Principal: "key1", ClientIp: "", RequestId: "trace1"}, actor)
+}
+
+func (s *UnitTestSuite) Test_Signals_CarryActor() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		eb:     *errs.B(),
+	}
+
+	actor := workflow.Actor{Principal: "key1", ClientIp: "203.0.113.7", RequestId: "req1"}
+	ctx := withActor(tenantContext(testTenant), actor)
+
+	mockClient.On("SignalWorkflow", mock.Anything, "1234", "", workflow.AddLineItem, mock.MatchedBy(func(signal workflow.AddLineItemSignal) bool {
+		return signal.Actor == actor
+	})).Return(nil)
+	mockClient.On("SignalWorkflow", mock.Anything, "1234", "", "closeBill", workflow.CloseBillSignal{Actor: actor}).Return(nil)
+
+	mockEncodedValue := &MockEncodedValue{}
+	mockEncodedValue.On("Get").Return(nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(mockEncodedValue, nil)
+
+	_, err := service.AddLineItem(ctx, &AddLineItemRequest{BillId: "1234", Description: "item1", Amount: 10.0})
+	s.NoError(err)
+
+	_, err = service.CloseBill(ctx, &CloseBillRequest{Id: "1234"})
+	s.NoError(err)
+}
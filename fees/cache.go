@@ -0,0 +1,107 @@
+package fees
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"encore.app/fees/workflow"
+)
+
+// Open bills can change without the service signalling them (late fees, other instances),
+// so they are only cached briefly, as are closed bills with late fees left to charge.
+// Other closed bills never change and are kept until evicted.
+var (
+	billCacheSize = 10000
+	openBillTTL   = 30 * time.Second
+)
+
+// billCache is an in-process LRU cache of bill state, safe for concurrent use.
+// A nil cache caches nothing.
+type billCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	now     func() time.Time
+}
+
+type billCacheEntry struct {
+	bill      workflow.Bill
+	expiresAt time.Time // zero for closed bills that can no longer change
+}
+
+func newBillCache() *billCache {
+	return &billCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *billCache) Get(id string) (*workflow.Bill, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*billCacheEntry)
+	if !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	bill := entry.bill
+	return &bill, true
+}
+
+// Put caches the bill unless a later version of it is already cached
+func (c *billCache) Put(bill workflow.Bill) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &billCacheEntry{bill: bill}
+	if bill.ClosedOn == nil || bill.AccruesLateFees() {
+		entry.expiresAt = c.now().Add(openBillTTL)
+	}
+
+	if e, ok := c.entries[bill.Id]; ok {
+		if e.Value.(*billCacheEntry).bill.Version > bill.Version {
+			return
+		}
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[bill.Id] = c.lru.PushFront(entry)
+	if c.lru.Len() > billCacheSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops the bill, called whenever the service changes it
+func (c *billCache) Invalidate(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *billCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*billCacheEntry).bill.Id)
+	c.lru.Remove(e)
+}
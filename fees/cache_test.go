@@ -0,0 +1,129 @@
+package fees
+
+import (
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+func (s *UnitTestSuite) Test_BillCache_ExpiresOpenBills() {
+	now := time.Now()
+	cache := newBillCache()
+	cache.now = func() time.Time { return now }
+
+	closed := now
+	cache.Put(workflow.Bill{Id: "open"})
+	cache.Put(workflow.Bill{Id: "closed", ClosedOn: &closed})
+
+	now = now.Add(openBillTTL)
+
+	_, ok := cache.Get("open")
+	s.False(ok)
+	_, ok = cache.Get("closed")
+	s.True(ok)
+}
+
+func (s *UnitTestSuite) Test_BillCache_ExpiresClosedBillsAccruingLateFees() {
+	now := time.Now()
+	cache := newBillCache()
+	cache.now = func() time.Time { return now }
+
+	closed, due := now, now.Add(time.Hour)
+	cache.Put(workflow.Bill{
+		Id:            "accruing",
+		ClosedOn:      &closed,
+		DueDate:       &due,
+		LateFeePolicy: &workflow.LateFeePolicy{FlatFee: 5.0},
+	})
+
+	now = now.Add(openBillTTL)
+
+	_, ok := cache.Get("accruing")
+	s.False(ok)
+}
+
+func (s *UnitTestSuite) Test_BillCache_KeepsLatestVersion() {
+	cache := newBillCache()
+
+	cache.Put(workflow.Bill{Id: "1", Version: 3, TotalAmount: 30.0})
+	cache.Put(workflow.Bill{Id: "1", Version: 2, TotalAmount: 20.0})
+
+	bill, ok := cache.Get("1")
+	s.True(ok)
+	s.Equal(3, bill.Version)
+
+	cache.Invalidate("1")
+	_, ok = cache.Get("1")
+	s.False(ok)
+}
+
+func (s *UnitTestSuite) Test_BillCache_EvictsLeastRecentlyUsed() {
+	size := billCacheSize
+	billCacheSize = 2
+	defer func() { billCacheSize = size }()
+
+	cache := newBillCache()
+	cache.Put(workflow.Bill{Id: "1"})
+	cache.Put(workflow.Bill{Id: "2"})
+	cache.Get("1")
+	cache.Put(workflow.Bill{Id: "3"})
+
+	_, ok := cache.Get("1")
+	s.True(ok)
+	_, ok = cache.Get("2")
+	s.False(ok)
+}
+
+func (s *UnitTestSuite) Test_GetBill_Cached() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(),
+		cache:  newBillCache(),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	mockEncodedValue := &MockEncodedValue{}
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(mockEncodedValue, nil).Once()
+
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{})
+	s.NoError(err)
+	s.Equal(mockBill.TotalAmount, bill.TotalAmount)
+
+	// Served from the cache, the workflow is only queried once
+	bill, err = service.GetBill(ctx, "1234", &GetBillParams{})
+	s.NoError(err)
+	s.Equal(mockBill.TotalAmount, bill.TotalAmount)
+}
+
+func (s *UnitTestSuite) Test_AddLineItem_InvalidatesCache() {
+	mockClient := mocks.NewClient(s.T())
+	cache := newBillCache()
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		cache:  cache,
+		eb:     *errs.B(),
+	}
+
+	cache.Put(workflow.Bill{Id: "1234", Version: 5, TotalAmount: 5.0})
+
+	mockClient.On("SignalWorkflow", mock.Anything, "1234", "", workflow.AddLineItem, mock.Anything).Return(nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(&MockBillValue{
+		bill: workflow.Bill{Currency: "USD", TotalAmount: 1.0, Version: 1},
+	}, nil)
+
+	_, err := service.AddLineItem(tenantContext(testTenant), &AddLineItemRequest{BillId: "1234", Description: "item", Amount: 1.0})
+	s.NoError(err)
+
+	// The stale entry was dropped, so the state returned by the query replaced it despite its lower version
+	bill, ok := cache.Get("1234")
+	s.True(ok)
+	s.Equal(1.0, bill.TotalAmount)
+}
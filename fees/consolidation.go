@@ -0,0 +1,210 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+)
+
+// ConsolidateBillsRequest rolls the closed bills of a parent's child accounts into one bill for the period
+type ConsolidateBillsRequest struct {
+	CustomerId string `json:"customerId"` // the parent account
+	Period     string `json:"period"`     // YYYY-MM, it must have ended
+	Currency   string `json:"currency"`   // defaults to the parent's default currency, child bills in others are left out
+}
+
+// AccountSubtotal is what one child account contributes to the consolidated bill
+type AccountSubtotal struct {
+	CustomerId string   `json:"customerId"`
+	BillIds    []string `json:"billIds"`
+	Amount     float64  `json:"amount"`
+}
+
+type ConsolidateBillsResponse struct {
+	Id          string            `json:"id"`
+	Existing    bool              `json:"existing"` // the period was already consolidated, the existing bill is returned
+	Currency    string            `json:"currency"`
+	Subtotals   []AccountSubtotal `json:"subtotals"`   // by child account, voided items are left out
+	TotalAmount float64           `json:"totalAmount"` // the parent bill's total, including any items added to it since
+}
+
+// ConsolidateBills opens a bill for the parent account with one line item per closed bill of its child accounts.
+// The bills are those closed within the period. Each period is consolidated once, later calls return the same bill.
+// encore:api auth method=POST path=/api/customer/consolidate
+func (s *Service) ConsolidateBills(ctx context.Context, req *ConsolidateBillsRequest) (*ConsolidateBillsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CustomerId == "" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("customer id is required").Err()
+	}
+	start, err := time.Parse(billingPeriodLayout, req.Period)
+	if err != nil {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid period, use YYYY-MM").Err()
+	}
+	end := start.AddDate(0, 1, 0)
+	if time.Now().Before(end) {
+		return nil, s.eb.Code(errs.FailedPrecondition).Msg("the period has not ended yet").Err()
+	}
+
+	parent, err := s.customers.GetCustomer(ctx, tenant.Id, req.CustomerId)
+	if errors.Is(err, errCustomerNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("customer not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading customer", "id", req.CustomerId, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to consolidate bills").Err()
+	}
+
+	currency := req.Currency
+	if currency == "" {
+		currency = parent.DefaultCurrency
+	}
+	if !tenant.allows(currency) {
+		return nil, s.unsupportedCurrency(tenant)
+	}
+
+	children, err := s.customers.ListChildCustomers(ctx, tenant.Id, parent.Id)
+	if err != nil {
+		rlog.Error("Error listing child customers", "id", parent.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to consolidate bills").Err()
+	}
+	if len(children) == 0 {
+		return nil, s.eb.Code(errs.FailedPrecondition).Msg("the customer has no child accounts").Err()
+	}
+
+	now := time.Now()
+	actor := actorOf(ctx)
+	bill := workflow.Bill{
+		Currency:   currency,
+		CustomerId: parent.Id,
+		TenantId:   tenant.Id,
+		LineItems:  make([]workflow.LineItem, 0),
+		CreatedAt:  &now,
+		CreatedBy:  &actor,
+		Period:     req.Period,
+	}
+
+	for _, child := range children {
+		bills, err := s.closedBills(ctx, billFilter{
+			TenantId:     tenant.Id,
+			Status:       workflow.StatusClosed,
+			Currency:     currency,
+			CustomerId:   child.Id,
+			ClosedAfter:  &start,
+			ClosedBefore: &end,
+		})
+		if err != nil {
+			rlog.Error("Error listing child bills", "id", child.Id, "error", err)
+			return nil, s.eb.Code(errs.Internal).Msg("unable to consolidate bills").Err()
+		}
+
+		for _, b := range bills {
+			// Bills with nothing to pay would only add noise to the parent's bill
+			if b.TotalAmount == 0 {
+				continue
+			}
+			bill.LineItems = append(bill.LineItems, workflow.LineItem{
+				Id:          "consolidated-" + b.Id,
+				Description: fmt.Sprintf("%s, bill %s", child.Name, b.Id),
+				Amount:      b.TotalAmount,
+				Type:        workflow.LineItemConsolidated,
+				CreatedAt:   &now,
+				Source:      &workflow.BillReference{BillId: b.Id, CustomerId: child.Id},
+			})
+			bill.TotalAmount += b.TotalAmount
+		}
+	}
+	if len(bill.LineItems) == 0 {
+		return nil, s.eb.Code(errs.FailedPrecondition).Msgf("no child account bills in %s were closed in %s", currency, req.Period).Err()
+	}
+
+	// The stable ID makes Temporal refuse a second consolidation of the period.
+	// A consolidated period keeps its bill, even if more child bills were closed since.
+	billId := consolidatedBillId(tenant.Id, parent.Id, req.Period)
+	options := client.StartWorkflowOptions{
+		ID:                                       billId,
+		TaskQueue:                                billTaskQueue,
+		WorkflowIDReusePolicy:                    enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		WorkflowExecutionErrorWhenAlreadyStarted: true,
+	}
+
+	rlog.Info("Starting consolidated bill workflow", "id", billId, "tenant", tenant.Id, "lineItems", len(bill.LineItems))
+
+	_, err = s.client.ExecuteWorkflow(ctx, options, workflow.BillWorkflow, bill)
+	if isAlreadyStarted(err) {
+		existing, err := s.getBill(ctx, billId)
+		if err != nil {
+			return nil, err
+		}
+		return consolidatedResponse(existing, true), nil
+	}
+	if err != nil {
+		rlog.Error("Error starting consolidated bill workflow", "id", billId, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to consolidate bills").Err()
+	}
+
+	bill.Id = billId
+	return consolidatedResponse(&bill, false), nil
+}
+
+// consolidatedBillId is the workflow ID of the parent's consolidated bill for the period.
+// It is kept apart from the bill CreateBill opens for the parent's own charges in the period.
+func consolidatedBillId(tenantId string, customerId string, period string) string {
+	return periodBillId(tenantId, customerId, period) + "-consolidated"
+}
+
+// closedBills reads every bill matching the filter, a page at a time
+func (s *Service) closedBills(ctx context.Context, filter billFilter) ([]BillListItem, error) {
+	query := billQuery{billFilter: filter, Limit: maxPageSize}
+
+	bills := make([]BillListItem, 0)
+	for {
+		page, err := s.store.ListBills(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		bills = append(bills, page...)
+		if len(page) < query.Limit {
+			return bills, nil
+		}
+		cursor := nextBillCursor(page[len(page)-1], query.Sort)
+		query.After = &cursor
+	}
+}
+
+// consolidatedResponse sums the consolidated items still on the bill by the child account they came from
+func consolidatedResponse(bill *workflow.Bill, existing bool) *ConsolidateBillsResponse {
+	res := &ConsolidateBillsResponse{
+		Id:          bill.Id,
+		Existing:    existing,
+		Currency:    bill.Currency,
+		Subtotals:   make([]AccountSubtotal, 0),
+		TotalAmount: bill.TotalAmount,
+	}
+
+	accounts := make(map[string]int)
+	for _, item := range bill.LineItems {
+		if item.Type != workflow.LineItemConsolidated || item.Source == nil || item.VoidedAt != nil {
+			continue
+		}
+		i, ok := accounts[item.Source.CustomerId]
+		if !ok {
+			i = len(res.Subtotals)
+			accounts[item.Source.CustomerId] = i
+			res.Subtotals = append(res.Subtotals, AccountSubtotal{CustomerId: item.Source.CustomerId})
+		}
+		res.Subtotals[i].BillIds = append(res.Subtotals[i].BillIds, item.Source.BillId)
+		res.Subtotals[i].Amount += item.Amount
+	}
+	return res
+}
@@ -0,0 +1,154 @@
+package fees
+
+import (
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/mocks"
+)
+
+var (
+	testParent = Customer{Id: "parent", Name: "Acme Group", DefaultCurrency: "USD"}
+	testChild1 = Customer{Id: "child1", Name: "Acme Batumi", DefaultCurrency: "USD", ParentId: "parent"}
+	testChild2 = Customer{Id: "child2", Name: "Acme Tbilisi", DefaultCurrency: "USD", ParentId: "parent"}
+)
+
+// consolidationBills are the bills of the child accounts around September 2024
+func consolidationBills() []workflow.Bill {
+	at := func(day int) *time.Time {
+		t := time.Date(2024, 9, day, 12, 0, 0, 0, time.UTC)
+		return &t
+	}
+	return []workflow.Bill{
+		{Id: "b1", Currency: "USD", CustomerId: "child1", TotalAmount: 10.0, CreatedAt: at(1), ClosedOn: at(10)},
+		{Id: "b2", Currency: "USD", CustomerId: "child1", TotalAmount: 5.5, CreatedAt: at(2), ClosedOn: at(20)},
+		{Id: "b3", Currency: "USD", CustomerId: "child2", TotalAmount: 7.0, CreatedAt: at(3), ClosedOn: at(15)},
+		// Left out: open, another currency, nothing to pay
+		{Id: "b4", Currency: "USD", CustomerId: "child2", TotalAmount: 3.0, CreatedAt: at(4)},
+		{Id: "b5", Currency: "GEL", CustomerId: "child2", TotalAmount: 9.0, CreatedAt: at(5), ClosedOn: at(16)},
+		{Id: "b7", Currency: "USD", CustomerId: "child2", TotalAmount: 0.0, CreatedAt: at(7), ClosedOn: at(17)},
+	}
+}
+
+func (s *UnitTestSuite) Test_ConsolidateBills() {
+	mockClient := mocks.NewClient(s.T())
+	store := newFakeBillStore(consolidationBills()...)
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		store:     store,
+		customers: newFakeCustomerStore(testParent, testChild1, testChild2),
+		eb:        *errs.B(),
+	}
+	id := "default-parent-2024-09-consolidated"
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
+	var started workflow.Bill
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.MatchedBy(func(options client.StartWorkflowOptions) bool {
+		return options.ID == id && options.WorkflowIDReusePolicy == enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE
+	}), mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		started = args.Get(3).(workflow.Bill)
+	}).Return(mockWorkflowRun, nil)
+
+	resp, err := service.ConsolidateBills(tenantContext(testTenant), &ConsolidateBillsRequest{CustomerId: testParent.Id, Period: "2024-09"})
+	s.NoError(err)
+	s.Equal(id, resp.Id)
+	s.False(resp.Existing)
+	s.Equal("USD", resp.Currency)
+	s.Equal(22.5, resp.TotalAmount)
+	s.Equal([]AccountSubtotal{
+		{CustomerId: "child1", BillIds: []string{"b1", "b2"}, Amount: 15.5},
+		{CustomerId: "child2", BillIds: []string{"b3"}, Amount: 7.0},
+	}, resp.Subtotals)
+
+	// The database leaves out the bills closed outside the period
+	september := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	october := september.AddDate(0, 1, 0)
+	s.Equal(billFilter{
+		TenantId:     testTenant.Id,
+		Status:       workflow.StatusClosed,
+		Currency:     "USD",
+		CustomerId:   "child1",
+		ClosedAfter:  &september,
+		ClosedBefore: &october,
+	}, store.queries[0].billFilter)
+
+	// The parent's bill links each item to the child bill it rolls up
+	s.Equal(testParent.Id, started.CustomerId)
+	s.Equal("2024-09", started.Period)
+	s.Equal(22.5, started.TotalAmount)
+	s.Len(started.LineItems, 3)
+	s.Equal("consolidated-b1", started.LineItems[0].Id)
+	s.Equal(workflow.LineItemConsolidated, started.LineItems[0].Type)
+	s.Equal(&workflow.BillReference{BillId: "b1", CustomerId: "child1"}, started.LineItems[0].Source)
+}
+
+func (s *UnitTestSuite) Test_ConsolidateBills_AlreadyConsolidated() {
+	mockClient := mocks.NewClient(s.T())
+	id := "default-parent-2024-09-consolidated"
+	now := time.Now()
+	existing := workflow.Bill{
+		Id:          id,
+		Currency:    "USD",
+		CustomerId:  testParent.Id,
+		TotalAmount: 12.0,
+		CreatedAt:   &now,
+		LineItems: []workflow.LineItem{
+			{Id: "consolidated-b1", Amount: 10.0, Type: workflow.LineItemConsolidated, Source: &workflow.BillReference{BillId: "b1", CustomerId: "child1"}},
+			{Id: "consolidated-b3", Amount: 7.0, Type: workflow.LineItemConsolidated, Source: &workflow.BillReference{BillId: "b3", CustomerId: "child2"}, VoidedAt: &now},
+			{Id: "fee", Amount: 2.0, Type: workflow.LineItemFee},
+		},
+	}
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		store:     newFakeBillStore(append(consolidationBills(), existing)...),
+		customers: newFakeCustomerStore(testParent, testChild1, testChild2),
+		cache:     newBillCache(),
+		eb:        *errs.B(),
+	}
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, serviceerror.NewWorkflowExecutionAlreadyStarted("workflow execution already started", "", "run1"))
+
+	// The existing bill is returned as it is now, voided items no longer count
+	resp, err := service.ConsolidateBills(tenantContext(testTenant), &ConsolidateBillsRequest{CustomerId: testParent.Id, Period: "2024-09"})
+	s.NoError(err)
+	s.Equal(id, resp.Id)
+	s.True(resp.Existing)
+	s.Equal(12.0, resp.TotalAmount)
+	s.Equal([]AccountSubtotal{{CustomerId: "child1", BillIds: []string{"b1"}, Amount: 10.0}}, resp.Subtotals)
+}
+
+func (s *UnitTestSuite) Test_ConsolidateBills_Invalid() {
+	// Only the bills with nothing to consolidate
+	service := &Service{
+		client:    mocks.NewClient(s.T()),
+		worker:    nil,
+		store:     newFakeBillStore(consolidationBills()[3:]...),
+		customers: newFakeCustomerStore(testParent, testChild1, testChild2, testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	nextMonth := time.Now().AddDate(0, 1, 0).Format(billingPeriodLayout)
+	tests := []struct {
+		req *ConsolidateBillsRequest
+		err string
+	}{
+		{&ConsolidateBillsRequest{Period: "2024-09"}, "invalid_argument: customer id is required"},
+		{&ConsolidateBillsRequest{CustomerId: testParent.Id, Period: "September"}, "invalid_argument: invalid period, use YYYY-MM"},
+		{&ConsolidateBillsRequest{CustomerId: testParent.Id, Period: nextMonth}, "failed_precondition: the period has not ended yet"},
+		{&ConsolidateBillsRequest{CustomerId: "unknown", Period: "2024-09"}, "not_found: customer not found"},
+		{&ConsolidateBillsRequest{CustomerId: testParent.Id, Period: "2024-09", Currency: "EUR"}, "invalid_argument: unsupported currency, only USD or GEL"},
+		{&ConsolidateBillsRequest{CustomerId: testCustomer.Id, Period: "2024-09"}, "failed_precondition: the customer has no child accounts"},
+		{&ConsolidateBillsRequest{CustomerId: testParent.Id, Period: "2024-08"}, "failed_precondition: no child account bills in USD were closed in 2024-08"},
+	}
+	for _, test := range tests {
+		_, err := service.ConsolidateBills(ctx, test.req)
+		s.EqualError(err, test.err, test.req)
+	}
+}
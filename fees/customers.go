@@ -0,0 +1,393 @@
+package fees
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+)
+
+var errCustomerNotFound = errors.New("customer not found")
+
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2
+}
+
+type Customer struct {
+	Id              string    `json:"id"`
+	TenantId        string    `json:"tenantId"`
+	Name            string    `json:"name"`
+	BillingAddress  Address   `json:"billingAddress"`
+	DefaultCurrency string    `json:"defaultCurrency"` // used for bills created without a currency
+	TaxId           string    `json:"taxId"`
+	ParentId        string    `json:"parentId"` // the parent account whose bill consolidates this customer's, empty for none
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+type CreateCustomerRequest struct {
+	Name            string  `json:"name"`
+	BillingAddress  Address `json:"billingAddress"`
+	DefaultCurrency string  `json:"defaultCurrency"`
+	TaxId           string  `json:"taxId"`
+	ParentId        string  `json:"parentId"`
+}
+
+// UpdateCustomerRequest replaces the details of the customer
+type UpdateCustomerRequest struct {
+	Id              string  `json:"id"`
+	Name            string  `json:"name"`
+	BillingAddress  Address `json:"billingAddress"`
+	DefaultCurrency string  `json:"defaultCurrency"`
+	TaxId           string  `json:"taxId"`
+	ParentId        string  `json:"parentId"`
+}
+
+type GetCustomersParams struct {
+	PageSize int    `query:"pageSize"` // defaults to 50, at most 200
+	Cursor   string `query:"cursor"`   // nextCursor of the previous page
+}
+
+type GetCustomersResponse struct {
+	Customers  []Customer `json:"customers"` // ordered by name
+	NextCursor string     `json:"nextCursor"` // empty on the last page
+}
+
+// encore:api auth method=POST path=/api/customer
+func (s *Service) CreateCustomer(ctx context.Context, req *CreateCustomerRequest) (*Customer, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	customer := Customer{
+		Id:              uuid.New().String(),
+		TenantId:        tenant.Id,
+		Name:            strings.TrimSpace(req.Name),
+		BillingAddress:  req.BillingAddress,
+		DefaultCurrency: req.DefaultCurrency,
+		TaxId:           strings.TrimSpace(req.TaxId),
+		ParentId:        req.ParentId,
+	}
+	if err := s.validateCustomer(tenant, customer); err != nil {
+		return nil, err
+	}
+	if err := s.validateParent(ctx, customer); err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Creating customer", "id", customer.Id)
+
+	created, err := s.customers.CreateCustomer(ctx, customer)
+	if err != nil {
+		rlog.Error("Error creating customer", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create customer").Err()
+	}
+	return created, nil
+}
+
+// encore:api auth method=POST path=/api/customer/update
+func (s *Service) UpdateCustomer(ctx context.Context, req *UpdateCustomerRequest) (*Customer, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	customer := Customer{
+		Id:              req.Id,
+		TenantId:        tenant.Id,
+		Name:            strings.TrimSpace(req.Name),
+		BillingAddress:  req.BillingAddress,
+		DefaultCurrency: req.DefaultCurrency,
+		TaxId:           strings.TrimSpace(req.TaxId),
+		ParentId:        req.ParentId,
+	}
+	if err := s.validateCustomer(tenant, customer); err != nil {
+		return nil, err
+	}
+	if err := s.validateParent(ctx, customer); err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Updating customer", "id", customer.Id)
+
+	updated, err := s.customers.UpdateCustomer(ctx, customer)
+	if errors.Is(err, errCustomerNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("customer not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error updating customer", "id", customer.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to update customer").Err()
+	}
+	return updated, nil
+}
+
+// encore:api auth method=GET path=/api/customer/:id
+func (s *Service) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	customer, err := s.customers.GetCustomer(ctx, tenant.Id, id)
+	if errors.Is(err, errCustomerNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("customer not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading customer", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get customer").Err()
+	}
+	return customer, nil
+}
+
+// encore:api auth method=GET path=/api/customers
+func (s *Service) GetCustomers(ctx context.Context, params *GetCustomersParams) (*GetCustomersResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor customerCursor
+	pageSize, paged, err := s.parsePage(params.PageSize, params.Cursor, &cursor)
+	if err != nil {
+		return nil, err
+	}
+	var after *customerCursor
+	if paged {
+		after = &cursor
+	}
+
+	customers, err := s.customers.ListCustomers(ctx, tenant.Id, pageSize+1, after)
+	if err != nil {
+		rlog.Error("Error listing customers", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get customers").Err()
+	}
+
+	customers, more := trimPage(customers, pageSize)
+	res := &GetCustomersResponse{Customers: customers}
+	if more {
+		last := customers[len(customers)-1]
+		res.NextCursor = encodeCursor(customerCursor{Name: last.Name, Id: last.Id})
+	}
+	return res, nil
+}
+
+// GetCustomerBills lists the bills of the customer, it takes the same parameters as GetBills.
+// encore:api auth method=GET path=/api/customer/:id/bills
+func (s *Service) GetCustomerBills(ctx context.Context, id string, params *GetBillsParams) (*GetBillsResponse, error) {
+	if _, err := s.GetCustomer(ctx, id); err != nil {
+		return nil, err
+	}
+
+	scoped := *params
+	scoped.CustomerId = id
+	return s.GetBills(ctx, &scoped)
+}
+
+// GetChildCustomers lists the child accounts of the customer, ordered by name.
+// encore:api auth method=GET path=/api/customer/:id/children
+func (s *Service) GetChildCustomers(ctx context.Context, id string) (*GetCustomersResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.GetCustomer(ctx, id); err != nil {
+		return nil, err
+	}
+
+	children, err := s.customers.ListChildCustomers(ctx, tenant.Id, id)
+	if err != nil {
+		rlog.Error("Error listing child customers", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get child customers").Err()
+	}
+	return &GetCustomersResponse{Customers: children}, nil
+}
+
+func (s *Service) validateCustomer(tenant *Tenant, customer Customer) error {
+	if customer.Name == "" {
+		return s.eb.Code(errs.InvalidArgument).Msg("name is required").Err()
+	}
+	if !tenant.allows(customer.DefaultCurrency) {
+		return s.eb.Code(errs.InvalidArgument).Msgf("unsupported default currency, only %s", strings.Join(tenant.AllowedCurrencies, " or ")).Err()
+	}
+	return nil
+}
+
+// validateParent keeps the account hierarchy a single level deep: the parent is another customer
+// of the tenant without a parent of its own, and a customer with child accounts cannot become one.
+func (s *Service) validateParent(ctx context.Context, customer Customer) error {
+	if customer.ParentId == "" {
+		return nil
+	}
+	if customer.ParentId == customer.Id {
+		return s.eb.Code(errs.InvalidArgument).Msg("a customer cannot be its own parent").Err()
+	}
+
+	parent, err := s.customers.GetCustomer(ctx, customer.TenantId, customer.ParentId)
+	if errors.Is(err, errCustomerNotFound) {
+		return s.eb.Code(errs.InvalidArgument).Msg("parent customer not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading parent customer", "id", customer.ParentId, "error", err)
+		return s.eb.Code(errs.Internal).Msg("unable to get parent customer").Err()
+	}
+	if parent.ParentId != "" {
+		return s.eb.Code(errs.InvalidArgument).Msg("the parent customer is a child account itself").Err()
+	}
+
+	children, err := s.customers.ListChildCustomers(ctx, customer.TenantId, customer.Id)
+	if err != nil {
+		rlog.Error("Error listing child customers", "id", customer.Id, "error", err)
+		return s.eb.Code(errs.Internal).Msg("unable to get child customers").Err()
+	}
+	if len(children) > 0 {
+		return s.eb.Code(errs.InvalidArgument).Msg("a customer with child accounts cannot have a parent").Err()
+	}
+	return nil
+}
+
+// customerRepository stores the customers bills are raised against, customers of other tenants are not found
+type customerRepository interface {
+	CreateCustomer(ctx context.Context, customer Customer) (*Customer, error)
+	UpdateCustomer(ctx context.Context, customer Customer) (*Customer, error)
+	GetCustomer(ctx context.Context, tenantId string, id string) (*Customer, error)
+	// ListCustomers returns up to limit customers ordered by name, after the cursor when it is set
+	ListCustomers(ctx context.Context, tenantId string, limit int, after *customerCursor) ([]Customer, error)
+	// ListChildCustomers returns the child accounts of the parent ordered by name
+	ListChildCustomers(ctx context.Context, tenantId string, parentId string) ([]Customer, error)
+}
+
+// customerCursor is the position of a customer in the listing order
+type customerCursor struct {
+	Name string `json:"name"`
+	Id   string `json:"id"`
+}
+
+func (c customerCursor) complete() bool {
+	return c.Id != ""
+}
+
+type customerStore struct {
+	db *sqldb.Database
+}
+
+const customerColumns = `id, tenant_id, name, billing_address, default_currency, tax_id, parent_id, created_at, updated_at`
+
+func (s *customerStore) CreateCustomer(ctx context.Context, customer Customer) (*Customer, error) {
+	address, err := json.Marshal(customer.BillingAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRow(ctx, `
+		INSERT INTO customers (id, tenant_id, name, billing_address, default_currency, tax_id, parent_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING `+customerColumns,
+		customer.Id, customer.TenantId, customer.Name, address, customer.DefaultCurrency, customer.TaxId, customer.ParentId)
+	return scanCustomer(row)
+}
+
+func (s *customerStore) UpdateCustomer(ctx context.Context, customer Customer) (*Customer, error) {
+	address, err := json.Marshal(customer.BillingAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRow(ctx, `
+		UPDATE customers
+		SET name = $3, billing_address = $4, default_currency = $5, tax_id = $6, parent_id = NULLIF($7, ''), updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING `+customerColumns,
+		customer.Id, customer.TenantId, customer.Name, address, customer.DefaultCurrency, customer.TaxId, customer.ParentId)
+	return scanCustomer(row)
+}
+
+func (s *customerStore) GetCustomer(ctx context.Context, tenantId string, id string) (*Customer, error) {
+	row := s.db.QueryRow(ctx, `SELECT `+customerColumns+` FROM customers WHERE id = $1 AND tenant_id = $2`, id, tenantId)
+	return scanCustomer(row)
+}
+
+func (s *customerStore) ListCustomers(ctx context.Context, tenantId string, limit int, after *customerCursor) ([]Customer, error) {
+	where := &sqlConditions{}
+	where.add("tenant_id = %s", tenantId)
+	if after != nil {
+		where.add("(name, id) > (%s, %s)", after.Name, after.Id)
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		`+where.String()+`
+		ORDER BY name, id
+		LIMIT `+where.arg(limit),
+		where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := make([]Customer, 0)
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, *customer)
+	}
+	return customers, rows.Err()
+}
+
+func (s *customerStore) ListChildCustomers(ctx context.Context, tenantId string, parentId string) ([]Customer, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		WHERE tenant_id = $1 AND parent_id = $2
+		ORDER BY name, id`,
+		tenantId, parentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := make([]Customer, 0)
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, *customer)
+	}
+	return customers, rows.Err()
+}
+
+func scanCustomer(row interface{ Scan(dest ...interface{}) error }) (*Customer, error) {
+	var customer Customer
+	var address []byte
+	var parentId *string
+	err := row.Scan(&customer.Id, &customer.TenantId, &customer.Name, &address, &customer.DefaultCurrency, &customer.TaxId,
+		&parentId, &customer.CreatedAt, &customer.UpdatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errCustomerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(address, &customer.BillingAddress); err != nil {
+		return nil, err
+	}
+	if parentId != nil {
+		customer.ParentId = *parentId
+	}
+	return &customer, nil
+}
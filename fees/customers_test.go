@@ -0,0 +1,305 @@
+package fees
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+var testCustomer = Customer{
+	Id:              "customer1",
+	Name:            "Acme",
+	BillingAddress:  Address{Line1: "1 Rustaveli Ave", City: "Tbilisi", Country: "GE"},
+	DefaultCurrency: "GEL",
+}
+
+type fakeCustomerStore struct {
+	mu        sync.Mutex
+	customers map[string]Customer
+}
+
+func newFakeCustomerStore(customers ...Customer) *fakeCustomerStore {
+	f := &fakeCustomerStore{customers: make(map[string]Customer)}
+	for _, c := range customers {
+		f.customers[c.Id] = c
+	}
+	return f
+}
+
+func (f *fakeCustomerStore) CreateCustomer(ctx context.Context, customer Customer) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	customer.CreatedAt = time.Now()
+	customer.UpdatedAt = customer.CreatedAt
+	f.customers[customer.Id] = customer
+	return &customer, nil
+}
+
+func (f *fakeCustomerStore) UpdateCustomer(ctx context.Context, customer Customer) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	existing, ok := f.customers[customer.Id]
+	if !ok || customerTenant(existing) != customer.TenantId {
+		return nil, errCustomerNotFound
+	}
+	customer.CreatedAt = existing.CreatedAt
+	customer.UpdatedAt = time.Now()
+	f.customers[customer.Id] = customer
+	return &customer, nil
+}
+
+func (f *fakeCustomerStore) GetCustomer(ctx context.Context, tenantId string, id string) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	customer, ok := f.customers[id]
+	if !ok || customerTenant(customer) != tenantId {
+		return nil, errCustomerNotFound
+	}
+	return &customer, nil
+}
+
+func (f *fakeCustomerStore) ListCustomers(ctx context.Context, tenantId string, limit int, after *customerCursor) ([]Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	customers := make([]Customer, 0)
+	for _, c := range f.customers {
+		if customerTenant(c) == tenantId {
+			customers = append(customers, c)
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		if customers[i].Name != customers[j].Name {
+			return customers[i].Name < customers[j].Name
+		}
+		return customers[i].Id < customers[j].Id
+	})
+
+	page := make([]Customer, 0)
+	for _, c := range customers {
+		if after != nil && (c.Name < after.Name || (c.Name == after.Name && c.Id <= after.Id)) {
+			continue
+		}
+		if len(page) == limit {
+			break
+		}
+		page = append(page, c)
+	}
+	return page, nil
+}
+
+func (f *fakeCustomerStore) ListChildCustomers(ctx context.Context, tenantId string, parentId string) ([]Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	children := make([]Customer, 0)
+	for _, c := range f.customers {
+		if customerTenant(c) == tenantId && c.ParentId == parentId {
+			children = append(children, c)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Name != children[j].Name {
+			return children[i].Name < children[j].Name
+		}
+		return children[i].Id < children[j].Id
+	})
+	return children, nil
+}
+
+// customerTenant mirrors the tenant_id column default for customers created without a tenant
+func customerTenant(customer Customer) string {
+	if customer.TenantId == "" {
+		return defaultTenantId
+	}
+	return customer.TenantId
+}
+
+func (s *UnitTestSuite) Test_CreateCustomer() {
+	service := &Service{
+		client:    mocks.NewClient(s.T()),
+		worker:    nil,
+		customers: newFakeCustomerStore(),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	created, err := service.CreateCustomer(ctx, &CreateCustomerRequest{
+		Name:            " Acme ",
+		BillingAddress:  Address{Line1: "1 Rustaveli Ave", City: "Tbilisi", Country: "GE"},
+		DefaultCurrency: "GEL",
+		TaxId:           "GE123456789",
+	})
+	s.NoError(err)
+	s.NotEmpty(created.Id)
+	s.Equal("Acme", created.Name)
+
+	customer, err := service.GetCustomer(ctx, created.Id)
+	s.NoError(err)
+	s.Equal("Tbilisi", customer.BillingAddress.City)
+	s.Equal("GE123456789", customer.TaxId)
+
+	_, err = service.CreateCustomer(ctx, &CreateCustomerRequest{DefaultCurrency: "USD"})
+	s.EqualError(err, "invalid_argument: name is required")
+
+	_, err = service.CreateCustomer(ctx, &CreateCustomerRequest{Name: "Acme", DefaultCurrency: "EUR"})
+	s.EqualError(err, "invalid_argument: unsupported default currency, only USD or GEL")
+
+	_, err = service.GetCustomer(ctx, "unknown")
+	s.EqualError(err, "not_found: customer not found")
+}
+
+func (s *UnitTestSuite) Test_UpdateCustomer() {
+	service := &Service{
+		client:    mocks.NewClient(s.T()),
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	updated, err := service.UpdateCustomer(ctx, &UpdateCustomerRequest{
+		Id:              testCustomer.Id,
+		Name:            "Acme Georgia",
+		BillingAddress:  testCustomer.BillingAddress,
+		DefaultCurrency: "USD",
+	})
+	s.NoError(err)
+	s.Equal("Acme Georgia", updated.Name)
+	s.Equal("USD", updated.DefaultCurrency)
+
+	_, err = service.UpdateCustomer(ctx, &UpdateCustomerRequest{Id: "unknown", Name: "Acme", DefaultCurrency: "USD"})
+	s.EqualError(err, "not_found: customer not found")
+}
+
+func (s *UnitTestSuite) Test_CustomerParent() {
+	service := &Service{
+		client:    mocks.NewClient(s.T()),
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	child, err := service.CreateCustomer(ctx, &CreateCustomerRequest{Name: "Acme Batumi", DefaultCurrency: "GEL", ParentId: testCustomer.Id})
+	s.NoError(err)
+	s.Equal(testCustomer.Id, child.ParentId)
+
+	children, err := service.GetChildCustomers(ctx, testCustomer.Id)
+	s.NoError(err)
+	s.Len(children.Customers, 1)
+	s.Equal(child.Id, children.Customers[0].Id)
+
+	// The hierarchy is a single level deep
+	_, err = service.CreateCustomer(ctx, &CreateCustomerRequest{Name: "Acme Kobuleti", DefaultCurrency: "GEL", ParentId: child.Id})
+	s.EqualError(err, "invalid_argument: the parent customer is a child account itself")
+	_, err = service.UpdateCustomer(ctx, &UpdateCustomerRequest{Id: testCustomer.Id, Name: "Acme", DefaultCurrency: "GEL", ParentId: "other"})
+	s.EqualError(err, "invalid_argument: parent customer not found")
+	_, err = service.UpdateCustomer(ctx, &UpdateCustomerRequest{Id: child.Id, Name: "Acme Batumi", DefaultCurrency: "GEL", ParentId: child.Id})
+	s.EqualError(err, "invalid_argument: a customer cannot be its own parent")
+
+	other, err := service.CreateCustomer(ctx, &CreateCustomerRequest{Name: "Basalt", DefaultCurrency: "USD"})
+	s.NoError(err)
+	_, err = service.UpdateCustomer(ctx, &UpdateCustomerRequest{Id: testCustomer.Id, Name: "Acme", DefaultCurrency: "GEL", ParentId: other.Id})
+	s.EqualError(err, "invalid_argument: a customer with child accounts cannot have a parent")
+
+	// Parents of other tenants are not found
+	_, err = service.CreateCustomer(tenantContext(otherTenant), &CreateCustomerRequest{Name: "Cobalt", DefaultCurrency: "USD", ParentId: other.Id})
+	s.EqualError(err, "invalid_argument: parent customer not found")
+}
+
+func (s *UnitTestSuite) Test_GetCustomers_Pagination() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		customers: newFakeCustomerStore(
+			Customer{Id: "3", Name: "Cobalt", DefaultCurrency: "USD"},
+			Customer{Id: "1", Name: "Acme", DefaultCurrency: "USD"},
+			Customer{Id: "2", Name: "Basalt", DefaultCurrency: "GEL"},
+		),
+		eb: *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	page, err := service.GetCustomers(ctx, &GetCustomersParams{PageSize: 2})
+	s.NoError(err)
+	s.Len(page.Customers, 2)
+	s.Equal("Acme", page.Customers[0].Name)
+	s.Equal("Basalt", page.Customers[1].Name)
+	s.NotEmpty(page.NextCursor)
+
+	page, err = service.GetCustomers(ctx, &GetCustomersParams{PageSize: 2, Cursor: page.NextCursor})
+	s.NoError(err)
+	s.Len(page.Customers, 1)
+	s.Equal("Cobalt", page.Customers[0].Name)
+	s.Empty(page.NextCursor)
+
+	_, err = service.GetCustomers(ctx, &GetCustomersParams{Cursor: "not-a-cursor"})
+	s.EqualError(err, "invalid_argument: invalid cursor")
+}
+
+func (s *UnitTestSuite) Test_CreateBill_CustomerDefaults() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
+	mockWorkflowRun.On("GetID").Return("123")
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.MatchedBy(func(bill workflow.Bill) bool {
+		return bill.CustomerId == testCustomer.Id && bill.Currency == "GEL"
+	})).Return(mockWorkflowRun, nil)
+
+	ctx := tenantContext(testTenant)
+
+	// Bills created without a currency are raised in the customer's default currency
+	resp, err := service.CreateBill(ctx, &CreateBillRequest{CustomerId: testCustomer.Id})
+	s.NoError(err)
+	s.Equal("123", resp.Id)
+
+	_, err = service.CreateBill(ctx, &CreateBillRequest{Currency: "USD"})
+	s.EqualError(err, "invalid_argument: customer id is required")
+
+	_, err = service.CreateBill(ctx, &CreateBillRequest{CustomerId: "unknown", Currency: "USD"})
+	s.EqualError(err, "not_found: customer not found")
+}
+
+func (s *UnitTestSuite) Test_GetCustomerBills() {
+	created := time.Now()
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store: newFakeBillStore(
+			workflow.Bill{Id: "1", Currency: "GEL", CustomerId: testCustomer.Id, CreatedAt: &created},
+			workflow.Bill{Id: "2", Currency: "USD", CustomerId: "customer2", CreatedAt: &created},
+			workflow.Bill{Id: "3", Currency: "USD", CustomerId: testCustomer.Id, CreatedAt: &created},
+		),
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	// The customer in the path takes precedence over the customerId parameter
+	resp, err := service.GetCustomerBills(ctx, testCustomer.Id, &GetBillsParams{CustomerId: "customer2"})
+	s.NoError(err)
+	s.Len(resp.Bills, 2)
+	for _, bill := range resp.Bills {
+		s.Equal(testCustomer.Id, bill.CustomerId)
+	}
+
+	resp, err = service.GetCustomerBills(ctx, testCustomer.Id, &GetBillsParams{Currency: "USD"})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("3", resp.Bills[0].Id)
+
+	_, err = service.GetCustomerBills(ctx, "unknown", &GetBillsParams{})
+	s.EqualError(err, "not_found: customer not found")
+}
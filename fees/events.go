@@ -0,0 +1,29 @@
+package fees
+
+import (
+	"context"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+type GetBillEventsResponse struct {
+	Events []workflow.BillEvent `json:"events"` // oldest first
+}
+
+// GetBillEvents returns the ledger of the bill, every change in the order it happened.
+// encore:api auth method=GET path=/api/bill/:id/events
+func (s *Service) GetBillEvents(ctx context.Context, id string) (*GetBillEventsResponse, error) {
+	if _, err := s.tenantBill(ctx, id); err != nil {
+		return nil, err
+	}
+
+	events, err := s.store.ListEvents(ctx, id)
+	if err != nil {
+		rlog.Error("Error reading bill events", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill events").Err()
+	}
+
+	return &GetBillEventsResponse{Events: events}, nil
+}
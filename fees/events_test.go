@@ -0,0 +1,64 @@
+package fees
+
+import (
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/mocks"
+)
+
+func (s *UnitTestSuite) Test_GetBillEvents_Success() {
+	store := newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"})
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	item := workflow.LineItem{Id: "a", Description: "Support", Amount: 10.0, Type: workflow.LineItemFee}
+	s.NoError(store.AppendEvents(ctx, []workflow.BillEvent{
+		{BillId: "1234", Sequence: 0, Type: workflow.EventCreated},
+		{BillId: "1234", Sequence: 1, Type: workflow.EventItemAdded, Item: &item},
+	}))
+
+	// A retried activity records the same events again
+	s.NoError(store.AppendEvents(ctx, []workflow.BillEvent{
+		{BillId: "1234", Sequence: 1, Type: workflow.EventItemAdded, Item: &item},
+		{BillId: "1234", Sequence: 2, Type: workflow.EventClosed},
+	}))
+
+	resp, err := service.GetBillEvents(ctx, "1234")
+	s.NoError(err)
+	s.Len(resp.Events, 3)
+	s.Equal(workflow.EventCreated, resp.Events[0].Type)
+	s.Equal("a", resp.Events[1].Item.Id)
+	s.Equal(workflow.EventClosed, resp.Events[2].Type)
+}
+
+func (s *UnitTestSuite) Test_GetBillEvents_UnknownBill() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:  mockClient,
+		worker:  nil,
+		store:   newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		archive: &diskArchive{dir: s.T().TempDir()},
+		eb:      *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	// Bills started before the ledger existed have no events
+	resp, err := service.GetBillEvents(ctx, "1234")
+	s.NoError(err)
+	s.Empty(resp.Events)
+
+	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, serviceerror.NewNotFound("workflow not found"))
+
+	resp, err = service.GetBillEvents(ctx, "5678")
+	s.EqualError(err, "not_found: bill not found")
+	s.Nil(resp)
+}
@@ -2,18 +2,24 @@ package fees
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"encore.app/fees/workflow"
 	"encore.dev/beta/errs"
 	"encore.dev/rlog"
 	"github.com/google/uuid"
-	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/api/enums/v1"
 	"go.temporal.io/sdk/client"
 )
 
 type CreateBillRequest struct {
-	Currency string `json:"currency"`
+	Currency string `json:"currency"` // defaults to the customer's default currency
+	CustomerId string `json:"customerId"` // the customer the bill is raised against
+	DueDate  *time.Time `json:"dueDate"`
+	LateFeePolicy *workflow.LateFeePolicy `json:"lateFeePolicy"` // applied once the bill is past its due date
+	Period string `json:"period"` // billing period as YYYY-MM, a customer has at most one bill per period
+	IdempotencyKey string `json:"idempotencyKey"` // retries with the same key return the bill created by the first request
 }
 
 type AddLineItemRequest struct {
@@ -39,27 +45,110 @@ type CloseBillResponse struct {
 
 type CreateBillResponse struct {
 	Id     string `json:"id"`
+	Existing bool `json:"existing"` // the bill for the period or idempotency key already existed, no bill was created
 }
 
 type GetBillRequest struct {
 	Id string `json:"id"`
 }
 
+type GetBillParams struct {
+	AsOf string `query:"asOf"` // RFC 3339, the bill as it was at that time
+	Version string `query:"version"` // the bill as it was at that version, 0 is the bill as created
+}
+
+type VoidLineItemRequest struct {
+	BillId string `json:"billId"`
+	ItemId string `json:"itemId"`
+	Reason string `json:"reason"`
+}
+
+type VoidLineItemResponse struct {
+	CurrentTotal float64 `json:"currentTotal"`
+	Version int `json:"version"`
+}
+
 type GetBillsParams struct {
 	Status string `query:"status"` // open, closed
+	Currency string `query:"currency"`
+	CustomerId string `query:"customerId"`
+	CreatedAfter string `query:"createdAfter"` // RFC 3339, inclusive
+	CreatedBefore string `query:"createdBefore"` // RFC 3339, exclusive
+	ClosedAfter string `query:"closedAfter"` // RFC 3339, inclusive
+	ClosedBefore string `query:"closedBefore"` // RFC 3339, exclusive
+	MinTotal float64 `query:"minTotal"` // inclusive
+	MaxTotal float64 `query:"maxTotal"` // exclusive, zero for no upper bound
+	Sort string `query:"sort"` // createdAt (default), totalAmount
+	Order string `query:"order"` // asc (default), desc
+	PageSize int `query:"pageSize"` // defaults to 50, at most 200
+	Cursor string `query:"cursor"` // nextCursor of the previous page
+	Expand string `query:"expand"` // lineItems to include the line items of each bill
+}
+
+// BillListItem summarises a bill when listing, line items are only included when expanded
+type BillListItem struct {
+	Id string `json:"id"`
+	Currency string `json:"currency"`
+	CustomerId string `json:"customerId"`
+	Status string `json:"status"`
+	TotalAmount float64 `json:"totalAmount"`
+	LineItemCount int `json:"lineItemCount"`
+	CreatedAt *time.Time `json:"createdAt"`
+	ClosedOn *time.Time `json:"closedOn"`
+	LineItems []workflow.LineItem `json:"lineItems,omitempty"`
 }
 
 type GetBillsResponse struct {
-	Bills []workflow.Bill `json:"bills"`
+	Bills []BillListItem `json:"bills"`
+	NextCursor string `json:"nextCursor"` // empty on the last page
 }
 
 var SupportedCurrencies = []string{"USD", "GEL"}
 
-// encore:api public method=POST path=/api/bill
+const billingPeriodLayout = "2006-01"
+
+const maxIdempotencyKeyLength = 255
+
+// billIdempotencyNamespace derives bill IDs from idempotency keys, it must never change
+var billIdempotencyNamespace = uuid.MustParse("d2269895-c8c9-41bd-958d-137738d90ff2")
+
+// encore:api auth method=POST path=/api/bill
 func (s *Service) CreateBill(ctx context.Context, req *CreateBillRequest) (*CreateBillResponse, error) {
-	// Validate if the currency is supported
-	if !contains(SupportedCurrencies, req.Currency) {
-			return nil, s.eb.Code(errs.InvalidArgument).Msg("unsupported currency, only USD or GEL").Err()
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+			return nil, err
+	}
+
+	if req.CustomerId == "" {
+			return nil, s.eb.Code(errs.InvalidArgument).Msg("customer id is required").Err()
+	}
+	customer, err := s.customers.GetCustomer(ctx, tenant.Id, req.CustomerId)
+	if errors.Is(err, errCustomerNotFound) {
+			return nil, s.eb.Code(errs.NotFound).Msg("customer not found").Err()
+	}
+	if err != nil {
+			rlog.Error("Error reading customer", "id", req.CustomerId, "error", err)
+			return nil, s.eb.Code(errs.Internal).Msg("unable to create bill").Err()
+	}
+
+	currency := req.Currency
+	if currency == "" {
+			currency = customer.DefaultCurrency
+	}
+
+	// Validate if the currency is allowed for the tenant
+	if !tenant.allows(currency) {
+			return nil, s.unsupportedCurrency(tenant)
+	}
+
+	// Late fees can only accrue against a due date
+	if req.LateFeePolicy != nil {
+			if req.DueDate == nil {
+					return nil, s.eb.Code(errs.InvalidArgument).Msg("due date is required for a late fee policy").Err()
+			}
+			if err := req.LateFeePolicy.Validate(); err != nil {
+					return nil, s.eb.Code(errs.InvalidArgument).Msg(err.Error()).Err()
+			}
 	}
 
 	// Generate a unique ID for the bill workflow
@@ -70,16 +159,52 @@ func (s *Service) CreateBill(ctx context.Context, req *CreateBillRequest) (*Crea
 			TaskQueue: billTaskQueue,
 	}
 
-	rlog.Info("Starting bill workflow", "id", billWorkFlowId)
+	// Bills for a period or an idempotency key get a stable ID, so Temporal refuses to start a second one.
+	// The period already makes the bill unique, so it takes precedence over the key.
+	stableId := ""
+	switch {
+	case req.Period != "":
+			if _, err := time.Parse(billingPeriodLayout, req.Period); err != nil {
+					return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid period, use YYYY-MM").Err()
+			}
+			stableId = periodBillId(tenant.Id, req.CustomerId, req.Period)
+	case req.IdempotencyKey != "":
+			if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+					return nil, s.eb.Code(errs.InvalidArgument).Msgf("idempotency key must be at most %d characters", maxIdempotencyKeyLength).Err()
+			}
+			stableId = idempotentBillId(tenant.Id, req.IdempotencyKey)
+	}
+	if stableId != "" {
+			billWorkFlowId = stableId
+			options.ID = billWorkFlowId
+			options.WorkflowIDReusePolicy = enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE
+			options.WorkflowExecutionErrorWhenAlreadyStarted = true
+	}
+
+	rlog.Info("Starting bill workflow", "id", billWorkFlowId, "tenant", tenant.Id)
 
 	now := time.Now()
+	actor := actorOf(ctx)
 	bill := workflow.Bill{
-			Currency: req.Currency,
+			Currency: currency,
+			CustomerId: req.CustomerId,
+			TenantId: tenant.Id,
 			LineItems: make([]workflow.LineItem, 0),
 			TotalAmount: 0.0,
 			CreatedAt: &now,
+			DueDate: req.DueDate,
+			LateFeePolicy: req.LateFeePolicy,
+			CreatedBy: &actor,
+			Period: req.Period,
 	}
 	we, err := s.client.ExecuteWorkflow(ctx, options, workflow.BillWorkflow, bill)
+	if isAlreadyStarted(err) {
+			rlog.Info("Bill already exists", "id", billWorkFlowId, "customerId", req.CustomerId, "period", req.Period)
+			return &CreateBillResponse{
+					Id: billWorkFlowId,
+					Existing: true,
+			}, nil
+	}
 	if err != nil {
 			return nil, s.eb.Code(errs.Internal).Msg("unable to create bill").Err()
 	}
@@ -89,14 +214,37 @@ func (s *Service) CreateBill(ctx context.Context, req *CreateBillRequest) (*Crea
 	}, nil
 }
 
-// encore:api public method=POST path=/api/bill/close
+// periodBillId is the workflow ID of the customer's bill for the period, scoped to the tenant
+func periodBillId(tenantId string, customerId string, period string) string {
+	return tenantId + "-" + customerId + "-" + period
+}
+
+// idempotentBillId is the workflow ID of the bill created with the idempotency key, keys are scoped to the tenant
+func idempotentBillId(tenantId string, key string) string {
+	return uuid.NewSHA1(billIdempotencyNamespace, []byte(tenantId+"\x00"+key)).String()
+}
+
+// encore:api auth method=POST path=/api/bill/close
 func (s *Service) CloseBill(ctx context.Context, req *CloseBillRequest) (*CloseBillResponse, error) {
 	rlog.Info("Closing bill", "id", req.Id)
 
-	err := s.client.SignalWorkflow(ctx, req.Id, "", "closeBill", workflow.CloseBillSignal{})
+	current, err := s.tenantBill(ctx, req.Id)
 	if err != nil {
+			return nil, err
+	}
+	// The workflow of a closed bill keeps running while late fees are left to charge, and ignores the signal
+	if current.ClosedOn != nil {
+			return nil, s.eb.Code(errs.FailedPrecondition).Msg("bill is closed").Err()
+	}
+
+	err = s.client.SignalWorkflow(ctx, req.Id, "", "closeBill", workflow.CloseBillSignal{Actor: actorOf(ctx)})
+	if err != nil {
+			if isNotFound(err) {
+					return nil, s.billNotOpenError(ctx, req.Id)
+			}
 			return nil, s.eb.Code(errs.Internal).Msg("unable to cancel bill workflow").Err()
 	}
+	s.cache.Invalidate(req.Id)
 
 	// Query the workflow to get the current state
 	res, err := s.client.QueryWorkflow(ctx, req.Id, "", workflow.GetBill)
@@ -106,6 +254,8 @@ func (s *Service) CloseBill(ctx context.Context, req *CloseBillRequest) (*CloseB
 
 	var bill workflow.Bill
 	res.Get(&bill)
+	bill.Id = req.Id
+	s.cache.Put(bill)
 
 	return &CloseBillResponse{
 			Id: req.Id,
@@ -114,7 +264,7 @@ func (s *Service) CloseBill(ctx context.Context, req *CloseBillRequest) (*CloseB
 	}, nil
 }
 
-// encore:api public method=POST path=/api/bill/add
+// encore:api auth method=POST path=/api/bill/add
 func (s *Service) AddLineItem(ctx context.Context, req *AddLineItemRequest) (*AddLineItemResponse, error) {
 	if req.Amount <= 0 {
 			return nil, s.eb.Code(errs.InvalidArgument).Msg("amount must be greater than 0").Err()
@@ -122,13 +272,24 @@ func (s *Service) AddLineItem(ctx context.Context, req *AddLineItemRequest) (*Ad
 
 	rlog.Info("Adding line item to bill", "description", req.Description, "amount", req.Amount)
 
+	if _, err := s.tenantBill(ctx, req.BillId); err != nil {
+			return nil, err
+	}
+
+	itemId := uuid.New().String()
 	err := s.client.SignalWorkflow(ctx, req.BillId, "", workflow.AddLineItem, workflow.AddLineItemSignal{
+			Id:          itemId,
 			Description: req.Description,
 			Amount:      req.Amount,
+			Actor:       actorOf(ctx),
 	})
 	if err != nil {
+			if isNotFound(err) {
+					return nil, s.billNotOpenError(ctx, req.BillId)
+			}
 			return nil, s.eb.Code(errs.Internal).Msg("unable to add line item to bill").Err()
 	}
+	s.cache.Invalidate(req.BillId)
 
 	bill, err := s.client.QueryWorkflow(ctx, req.BillId, "", workflow.GetBill)
 	if err != nil {
@@ -137,6 +298,13 @@ func (s *Service) AddLineItem(ctx context.Context, req *AddLineItemRequest) (*Ad
 
 	var b workflow.Bill
 	bill.Get(&b)
+	b.Id = req.BillId
+	s.cache.Put(b)
+
+	// The bill was closed while the signal was in flight
+	if b.IsRejected(itemId) {
+			return nil, s.eb.Code(errs.FailedPrecondition).Msg("bill is closed").Err()
+	}
 
 	return &AddLineItemResponse{
 			CurrentTotal: b.TotalAmount,
@@ -144,75 +312,250 @@ func (s *Service) AddLineItem(ctx context.Context, req *AddLineItemRequest) (*Ad
 	}, nil
 }
 
-// encore:api public method=GET path=/api/bill/:id
-func (s *Service) GetBill(ctx context.Context, id string) (*workflow.Bill, error) {
+// encore:api auth method=POST path=/api/bill/void
+func (s *Service) VoidLineItem(ctx context.Context, req *VoidLineItemRequest) (*VoidLineItemResponse, error) {
+	if req.ItemId == "" {
+			return nil, s.eb.Code(errs.InvalidArgument).Msg("item id is required").Err()
+	}
+
+	rlog.Info("Voiding line item", "billId", req.BillId, "itemId", req.ItemId)
+
+	if _, err := s.tenantBill(ctx, req.BillId); err != nil {
+			return nil, err
+	}
+
+	err := s.client.SignalWorkflow(ctx, req.BillId, "", workflow.VoidLineItem, workflow.VoidLineItemSignal{
+			ItemId: req.ItemId,
+			Reason: req.Reason,
+			Actor:  actorOf(ctx),
+	})
+	if err != nil {
+			if isNotFound(err) {
+					return nil, s.billNotOpenError(ctx, req.BillId)
+			}
+			return nil, s.eb.Code(errs.Internal).Msg("unable to void line item").Err()
+	}
+	s.cache.Invalidate(req.BillId)
+
+	res, err := s.client.QueryWorkflow(ctx, req.BillId, "", workflow.GetBill)
+	if err != nil {
+			return nil, s.eb.Code(errs.Internal).Msg("unable to get bill").Err()
+	}
+
+	var b workflow.Bill
+	res.Get(&b)
+	b.Id = req.BillId
+	s.cache.Put(b)
+
+	// The workflow ignores items the bill does not have
+	for _, item := range b.LineItems {
+			if item.Id == req.ItemId && item.VoidedAt != nil {
+					return &VoidLineItemResponse{
+							CurrentTotal: b.TotalAmount,
+							Version: b.Version,
+					}, nil
+			}
+	}
+	if b.ClosedOn != nil {
+			return nil, s.eb.Code(errs.FailedPrecondition).Msg("bill is closed").Err()
+	}
+	return nil, s.eb.Code(errs.NotFound).Msg("line item not found").Err()
+}
+
+// GetBill returns the current state of the bill, or the state it was in at asOf or at version.
+// encore:api auth method=GET path=/api/bill/:id
+func (s *Service) GetBill(ctx context.Context, id string, params *GetBillParams) (*workflow.Bill, error) {
+	if params.AsOf != "" || params.Version != "" {
+		return s.getBillAt(ctx, id, params)
+	}
+	return s.tenantBill(ctx, id)
+}
+
+func (s *Service) getBill(ctx context.Context, id string) (*workflow.Bill, error) {
 	rlog.Info("Getting bill", "id", id)
 
-	// Query the workflow to get the current state
+	if bill, ok := s.cache.Get(id); ok {
+		return bill, nil
+	}
+
+	bill, err := s.store.GetBill(ctx, id)
+	if err == nil {
+		s.cache.Put(*bill)
+		return bill, nil
+	}
+	if !errors.Is(err, errBillNotFound) {
+		rlog.Error("Error reading bill", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill").Err()
+	}
+
+	// Not projected yet, query the workflow to get the current state
 	res, err := s.client.QueryWorkflow(ctx, id, "", workflow.GetBill)
+	if isNotFound(err) {
+		return s.getArchivedBill(ctx, id)
+	}
 	if err != nil {
 		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill").Err()
 	}
 
-	var bill workflow.Bill
-	res.Get(&bill)
+	bill = &workflow.Bill{}
+	res.Get(bill)
 	bill.Id = id
+	s.cache.Put(*bill)
 
-	return &bill, nil
+	return bill, nil
 }
 
-// encore:api public method=GET path=/api/bills
+// getArchivedBill reads a closed bill whose workflow history is past retention
+func (s *Service) getArchivedBill(ctx context.Context, id string) (*workflow.Bill, error) {
+	bill, err := s.archive.GetArchivedBill(ctx, id)
+	if errors.Is(err, errBillNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("bill not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading archived bill", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill").Err()
+	}
+
+	s.cache.Put(*bill)
+	return bill, nil
+}
+
+// encore:api auth method=GET path=/api/bills
 func (s *Service) GetBills(ctx context.Context, params *GetBillsParams) (*GetBillsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.parseBillFilter(tenant, params.filterParams())
+	if err != nil {
+		return nil, err
+	}
 
-	var query string
-	switch params.Status {
-	case "":
-			query = "WorkflowType='BillWorkflow'"
-	case "closed":
-			query = "WorkflowType='BillWorkflow' and ExecutionStatus = 'Completed'"
-	case "open":
-			query = "WorkflowType='BillWorkflow' and ExecutionStatus = 'Running'"
-	default:
-			return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid status parameter, use open or closed").Err()
+	sort := billSort{Field: params.Sort, Descending: params.Order == "desc"}
+	if sort.Field == "" {
+		sort.Field = sortByCreatedAt
+	}
+	if sort.Field != sortByCreatedAt && sort.Field != sortByTotalAmount {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid sort parameter, use createdAt or totalAmount").Err()
 	}
-	
-	options := &workflowservice.ListWorkflowExecutionsRequest{
-		Query: query,
+	if params.Order != "" && params.Order != "asc" && params.Order != "desc" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid order parameter, use asc or desc").Err()
 	}
 
-	// Query the workflow to get the current state
-	res, err := s.client.ListWorkflow(ctx, options)
-	rlog.Info("Listing workflows", "res", res)
+	var cursor billCursor
+	pageSize, paged, err := s.parsePage(params.PageSize, params.Cursor, &cursor)
 	if err != nil {
-		rlog.Error("Error listing workflows", "error", err)
+		return nil, err
+	}
+
+	if params.Expand != "" && params.Expand != "lineItems" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid expand parameter, use lineItems").Err()
+	}
+
+	query := billQuery{billFilter: filter, Sort: sort, Limit: pageSize + 1, Expand: params.Expand == "lineItems"}
+	if paged {
+		// A cursor is only valid for the order it was issued in
+		if cursor.Sort != sort {
+			return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid cursor").Err()
+		}
+		query.After = &cursor
+	}
+
+	bills, err := s.store.ListBills(ctx, query)
+	if err != nil {
+		rlog.Error("Error listing bills", "error", err)
 		return nil, s.eb.Code(errs.Internal).Msg("unable to get bills").Err()
 	}
 
+	bills, more := trimPage(bills, pageSize)
+	res := &GetBillsResponse{Bills: bills}
+	if more {
+		res.NextCursor = encodeCursor(nextBillCursor(bills[len(bills)-1], sort))
+	}
 
-	var bills []workflow.Bill = make([]workflow.Bill, 0)
+	return res, nil
+}
 
-	for _, e := range res.Executions {
-		var bill workflow.Bill
-		workflowID := e.GetExecution().WorkflowId
-		runID := e.GetExecution().RunId
+// billFilterParams are the filter query parameters shared by the endpoints listing bills
+type billFilterParams struct {
+	Status, Currency, CustomerId string
+	CreatedAfter, CreatedBefore, ClosedAfter, ClosedBefore string
+	MinTotal, MaxTotal float64
+}
 
-		// Query the workflow for the bill details
-		queryRes, err := s.client.QueryWorkflow(ctx, workflowID, runID, workflow.GetBill)
-		if err != nil {
-				rlog.Error("Error querying workflow", "workflowID", workflowID, "runID", runID, "error", err)
-				continue
-		}
+func (p *GetBillsParams) filterParams() billFilterParams {
+	return billFilterParams{
+		Status: p.Status,
+		Currency: p.Currency,
+		CustomerId: p.CustomerId,
+		CreatedAfter: p.CreatedAfter,
+		CreatedBefore: p.CreatedBefore,
+		ClosedAfter: p.ClosedAfter,
+		ClosedBefore: p.ClosedBefore,
+		MinTotal: p.MinTotal,
+		MaxTotal: p.MaxTotal,
+	}
+}
 
-		err = queryRes.Get(&bill)
-		if err != nil {
-				rlog.Error("Error getting query result", "workflowID", workflowID, "runID", runID, "error", err)
-				continue
-		}
+// parseBillFilter parses the filter of the tenant's bills
+func (s *Service) parseBillFilter(tenant *Tenant, params billFilterParams) (billFilter, error) {
+	filter := billFilter{
+		TenantId: tenant.Id,
+		Status: params.Status,
+		Currency: params.Currency,
+		CustomerId: params.CustomerId,
+		MinTotal: params.MinTotal,
+		MaxTotal: params.MaxTotal,
+	}
 
-		bill.Id = workflowID
-		bills = append(bills, bill)
+	err := s.parseTimes(
+		timeParam{"createdAfter", params.CreatedAfter, &filter.CreatedAfter},
+		timeParam{"createdBefore", params.CreatedBefore, &filter.CreatedBefore},
+		timeParam{"closedAfter", params.ClosedAfter, &filter.ClosedAfter},
+		timeParam{"closedBefore", params.ClosedBefore, &filter.ClosedBefore},
+	)
+	if err != nil {
+		return filter, err
 	}
 
-	return &GetBillsResponse{Bills: bills}, nil
+	return filter, s.validateBillFilter(tenant, filter)
 }
 
+// validateBillFilter checks the filter, currencies the tenant does not allow are rejected like they are when creating bills
+func (s *Service) validateBillFilter(tenant *Tenant, filter billFilter) error {
+	if filter.Status != "" && filter.Status != workflow.StatusOpen && filter.Status != workflow.StatusClosed {
+		return s.eb.Code(errs.InvalidArgument).Msg("invalid status parameter, use open or closed").Err()
+	}
+	if filter.Currency != "" && !tenant.allows(filter.Currency) {
+		return s.unsupportedCurrency(tenant)
+	}
+	if filter.CreatedAfter != nil && filter.CreatedBefore != nil && !filter.CreatedAfter.Before(*filter.CreatedBefore) {
+		return s.eb.Code(errs.InvalidArgument).Msg("createdAfter must be before createdBefore").Err()
+	}
+	if filter.ClosedAfter != nil && filter.ClosedBefore != nil && !filter.ClosedAfter.Before(*filter.ClosedBefore) {
+		return s.eb.Code(errs.InvalidArgument).Msg("closedAfter must be before closedBefore").Err()
+	}
+	if filter.MinTotal < 0 || filter.MaxTotal < 0 {
+		return s.eb.Code(errs.InvalidArgument).Msg("totals must not be negative").Err()
+	}
+	if filter.MaxTotal > 0 && filter.MinTotal >= filter.MaxTotal {
+		return s.eb.Code(errs.InvalidArgument).Msg("minTotal must be less than maxTotal").Err()
+	}
+	return nil
+}
+
+// billNotOpenError explains why a bill could not be signalled, signals to closed workflows fail as not found
+func (s *Service) billNotOpenError(ctx context.Context, id string) error {
+	desc, err := s.client.DescribeWorkflowExecution(ctx, id, "")
+	if err != nil {
+		if isNotFound(err) {
+			return s.eb.Code(errs.NotFound).Msg("bill not found").Err()
+		}
+		return s.eb.Code(errs.Internal).Msg("unable to get bill").Err()
+	}
+
+	if desc.GetWorkflowExecutionInfo().GetStatus() != enums.WORKFLOW_EXECUTION_STATUS_RUNNING {
+		return s.eb.Code(errs.FailedPrecondition).Msg("bill is closed").Err()
+	}
+	return s.eb.Code(errs.Internal).Msg("unable to signal bill").Err()
+}
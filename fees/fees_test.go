@@ -3,12 +3,23 @@ package fees
 import (
 	"context"
 	"errors"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	workflow "encore.app/fees/workflow"
 	"encore.dev/beta/errs"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	temporalworkflow "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
 	"go.temporal.io/sdk/mocks"
 )
 
@@ -17,17 +28,17 @@ type UnitTestSuite struct {
 }
 
 type MockEncodedValue struct {
-  mock.Mock
+	mock.Mock
 }
 
 func (m *MockEncodedValue) HasValue() bool {
-  args := m.Called()
-  return args.Get(0).(bool)
+	args := m.Called()
+	return args.Get(0).(bool)
 }
 
 var mockBill = workflow.Bill{
-	Currency: "USD",
-	LineItems: []workflow.LineItem{},
+	Currency:    "USD",
+	LineItems:   []workflow.LineItem{},
 	TotalAmount: 1.0,
 }
 
@@ -36,6 +47,135 @@ func (m *MockEncodedValue) Get(valuePtr interface{}) error {
 	return nil
 }
 
+// fakeBillStore keeps bills and their events in maps. Listing and the audit trail are answered from the maps
+// matching only the tenant, status, currency and customer of each bill, in id order, stats and search return
+// canned results. The queries are recorded so tests can check what the service asked for, the SQL is tested in store_test.go.
+type fakeBillStore struct {
+	mu     sync.Mutex // bills are saved concurrently by the rebuild
+	bills  map[string]workflow.Bill
+	events map[string][]workflow.BillEvent
+
+	queries      []billQuery
+	filters      []billFilter
+	auditQueries []auditQuery
+	stats        []BillStats     // returned by AggregateBills
+	matches      []lineItemMatch // returned by SearchLineItems
+}
+
+func newFakeBillStore(bills ...workflow.Bill) *fakeBillStore {
+	f := &fakeBillStore{bills: make(map[string]workflow.Bill), events: make(map[string][]workflow.BillEvent)}
+	for _, b := range bills {
+		f.bills[b.Id] = b
+	}
+	return f
+}
+
+func (f *fakeBillStore) SaveBill(ctx context.Context, bill workflow.Bill) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Mirrors the version check of the upsert, older states never replace newer ones
+	if existing, ok := f.bills[bill.Id]; ok && existing.Version > bill.Version {
+		return nil
+	}
+	f.bills[bill.Id] = bill
+	return nil
+}
+
+func (f *fakeBillStore) GetBill(ctx context.Context, id string) (*workflow.Bill, error) {
+	bill, ok := f.bills[id]
+	if !ok {
+		return nil, errBillNotFound
+	}
+	return &bill, nil
+}
+
+func (f *fakeBillStore) AppendEvents(ctx context.Context, events []workflow.BillEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, event := range events {
+		if event.Sequence < len(f.events[event.BillId]) {
+			continue
+		}
+		f.events[event.BillId] = append(f.events[event.BillId], event)
+	}
+	return nil
+}
+
+func (f *fakeBillStore) ListEvents(ctx context.Context, billId string) ([]workflow.BillEvent, error) {
+	return append([]workflow.BillEvent{}, f.events[billId]...), nil
+}
+
+// matching returns the bills with the tenant, status, currency and customer of the filter, ordered by id
+func (f *fakeBillStore) matching(filter billFilter) []workflow.Bill {
+	bills := make([]workflow.Bill, 0)
+	for _, b := range f.bills {
+		if billTenant(&b) == filter.TenantId &&
+			(filter.Status == "" || b.Status() == filter.Status) &&
+			(filter.Currency == "" || b.Currency == filter.Currency) &&
+			(filter.CustomerId == "" || b.CustomerId == filter.CustomerId) {
+			bills = append(bills, b)
+		}
+	}
+	sort.Slice(bills, func(i, j int) bool { return bills[i].Id < bills[j].Id })
+	return bills
+}
+
+func (f *fakeBillStore) ListBills(ctx context.Context, query billQuery) ([]BillListItem, error) {
+	f.queries = append(f.queries, query)
+
+	page := make([]BillListItem, 0)
+	for _, b := range f.matching(query.billFilter) {
+		if len(page) == query.Limit {
+			break
+		}
+		item := BillListItem{
+			Id:            b.Id,
+			Currency:      b.Currency,
+			CustomerId:    b.CustomerId,
+			Status:        b.Status(),
+			TotalAmount:   b.TotalAmount,
+			LineItemCount: b.LineItemCount(),
+			CreatedAt:     b.CreatedAt,
+			ClosedOn:      b.ClosedOn,
+		}
+		if query.Expand {
+			item.LineItems = b.LineItems
+		}
+		page = append(page, item)
+	}
+	return page, nil
+}
+
+func (f *fakeBillStore) AggregateBills(ctx context.Context, filter billFilter) ([]BillStats, error) {
+	f.filters = append(f.filters, filter)
+	return append([]BillStats{}, f.stats...), nil
+}
+
+func (f *fakeBillStore) SearchLineItems(ctx context.Context, tenantId string, text string, limit int) ([]lineItemMatch, error) {
+	if len(f.matches) > limit {
+		return f.matches[:limit], nil
+	}
+	return append([]lineItemMatch{}, f.matches...), nil
+}
+
+func (f *fakeBillStore) ListAuditEvents(ctx context.Context, query auditQuery) ([]workflow.BillEvent, error) {
+	f.auditQueries = append(f.auditQueries, query)
+
+	events := make([]workflow.BillEvent, 0)
+	for _, b := range f.matching(billFilter{TenantId: query.TenantId}) {
+		for _, event := range f.events[b.Id] {
+			if len(events) == query.Limit {
+				return events, nil
+			}
+			if (query.Actor == "" || (event.Actor != nil && event.Actor.Principal == query.Actor)) &&
+				(query.BillId == "" || event.BillId == query.BillId) {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
 func TestUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(UnitTestSuite))
 }
@@ -43,17 +183,19 @@ func TestUnitTestSuite(t *testing.T) {
 func (s *UnitTestSuite) Test_CreateBill_Success() {
 	mockClient := mocks.NewClient(s.T())
 	service := &Service{
-		client: mockClient,
-		worker: nil,
-		eb:     *errs.B(),
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
 	}
-	mockWorkflowRun :=  mocks.NewWorkflowRun(s.T())
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
 	mockWorkflowRun.On("GetID").Return("123")
 	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockWorkflowRun, nil)
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 	req := &CreateBillRequest{
-		Currency: "USD",
+		CustomerId: testCustomer.Id,
+		Currency:   "USD",
 	}
 
 	resp, err := service.CreateBill(ctx, req)
@@ -61,19 +203,112 @@ func (s *UnitTestSuite) Test_CreateBill_Success() {
 	s.Equal("123", resp.Id)
 }
 
+func (s *UnitTestSuite) Test_CreateBill_Period() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+	id := "default-customer1-2024-09"
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
+	mockWorkflowRun.On("GetID").Return(id)
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.MatchedBy(func(options client.StartWorkflowOptions) bool {
+		return options.ID == id &&
+			options.WorkflowIDReusePolicy == enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE &&
+			options.WorkflowExecutionErrorWhenAlreadyStarted
+	}), mock.Anything, mock.MatchedBy(func(bill workflow.Bill) bool {
+		return bill.Period == "2024-09"
+	})).Return(mockWorkflowRun, nil)
+
+	ctx := tenantContext(testTenant)
+
+	resp, err := service.CreateBill(ctx, &CreateBillRequest{CustomerId: testCustomer.Id, Period: "2024-09"})
+	s.NoError(err)
+	s.Equal(id, resp.Id)
+	s.False(resp.Existing)
+
+	_, err = service.CreateBill(ctx, &CreateBillRequest{CustomerId: testCustomer.Id, Period: "September"})
+	s.EqualError(err, "invalid_argument: invalid period, use YYYY-MM")
+}
+
+func (s *UnitTestSuite) Test_CreateBill_PeriodAlreadyBilled() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, serviceerror.NewWorkflowExecutionAlreadyStarted("workflow execution already started", "", "run1"))
+
+	// The existing bill is returned rather than a second bill created
+	resp, err := service.CreateBill(tenantContext(testTenant), &CreateBillRequest{CustomerId: testCustomer.Id, Period: "2024-09"})
+	s.NoError(err)
+	s.Equal("default-customer1-2024-09", resp.Id)
+	s.True(resp.Existing)
+}
+
+func (s *UnitTestSuite) Test_CreateBill_IdempotencyKey() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+	id := idempotentBillId(testTenant.Id, "order-42")
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
+	mockWorkflowRun.On("GetID").Return(id)
+	stable := mock.MatchedBy(func(options client.StartWorkflowOptions) bool {
+		return options.ID == id && options.WorkflowIDReusePolicy == enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE
+	})
+	mockClient.On("ExecuteWorkflow", mock.Anything, stable, mock.Anything, mock.Anything).Return(mockWorkflowRun, nil).Once()
+	mockClient.On("ExecuteWorkflow", mock.Anything, stable, mock.Anything, mock.Anything).
+		Return(nil, serviceerror.NewWorkflowExecutionAlreadyStarted("workflow execution already started", "", "run1")).Once()
+
+	ctx := tenantContext(testTenant)
+	req := &CreateBillRequest{CustomerId: testCustomer.Id, IdempotencyKey: "order-42"}
+
+	resp, err := service.CreateBill(ctx, req)
+	s.NoError(err)
+	s.Equal(id, resp.Id)
+	s.False(resp.Existing)
+
+	// A retry gets the same bill, even though the first response was never seen
+	resp, err = service.CreateBill(ctx, req)
+	s.NoError(err)
+	s.Equal(id, resp.Id)
+	s.True(resp.Existing)
+
+	_, err = service.CreateBill(ctx, &CreateBillRequest{CustomerId: testCustomer.Id, IdempotencyKey: strings.Repeat("k", 256)})
+	s.EqualError(err, "invalid_argument: idempotency key must be at most 255 characters")
+}
+
+func (s *UnitTestSuite) Test_IdempotentBillId() {
+	id := idempotentBillId(testTenant.Id, "order-42")
+	s.Equal(id, idempotentBillId(testTenant.Id, "order-42"))
+	s.NotEqual(id, idempotentBillId(otherTenant.Id, "order-42"))
+	s.NotEqual(id, idempotentBillId(testTenant.Id, "order-43"))
+}
+
 func (s *UnitTestSuite) Test_CreateBill_WorkflowCreationFail() {
 	mockClient := mocks.NewClient(s.T())
 	service := &Service{
-		client: mockClient,
-		worker: nil,
-		eb:     *errs.B(),
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
 	}
 
 	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("error"))
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 	req := &CreateBillRequest{
-		Currency: "USD",
+		CustomerId: testCustomer.Id,
+		Currency:   "USD",
 	}
 
 	resp, err := service.CreateBill(ctx, req)
@@ -84,14 +319,16 @@ func (s *UnitTestSuite) Test_CreateBill_WorkflowCreationFail() {
 func (s *UnitTestSuite) Test_CreateBill_InvalidCurrency() {
 	mockClient := mocks.NewClient(s.T())
 	service := &Service{
-		client: mockClient,
-		worker: nil,
-		eb:     *errs.B(),
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 	req := &CreateBillRequest{
-		Currency: "EUR",
+		CustomerId: testCustomer.Id,
+		Currency:   "EUR",
 	}
 
 	resp, err := service.CreateBill(ctx, req)
@@ -105,10 +342,11 @@ func (s *UnitTestSuite) Test_CloseBill_Success() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
@@ -130,10 +368,11 @@ func (s *UnitTestSuite) Test_CloseBill_SignalFail() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("error"))
 
@@ -146,21 +385,38 @@ func (s *UnitTestSuite) Test_CloseBill_SignalFail() {
 	s.Nil(resp)
 }
 
+func (s *UnitTestSuite) Test_CloseBill_AlreadyClosed() {
+	mockClient := mocks.NewClient(s.T())
+	closed := time.Now()
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD", ClosedOn: &closed}),
+		eb:     *errs.B(),
+	}
+
+	// The workflow is still running to charge late fees, but the bill is not signalled again
+	resp, err := service.CloseBill(tenantContext(testTenant), &CloseBillRequest{Id: "1234"})
+	s.EqualError(err, "failed_precondition: bill is closed")
+	s.Nil(resp)
+}
+
 func (s *UnitTestSuite) Test_GetBill_Success() {
 	mockClient := mocks.NewClient(s.T())
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockEncodedValue := &MockEncodedValue{}
 	mockEncodedValue.On("Get").Return(nil)
 	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockEncodedValue, nil)
 
-	bill, err := service.GetBill(ctx, "1234")
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{})
 	s.NoError(err)
 	s.Equal(mockBill.Currency, bill.Currency)
 	s.Equal(mockBill.TotalAmount, bill.TotalAmount)
@@ -172,14 +428,15 @@ func (s *UnitTestSuite) Test_GetBill_Fail() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("error"))
 
-	bill, err := service.GetBill(ctx, "1234")
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{})
 	s.Error(err)
 	s.Nil(bill)
 }
@@ -189,10 +446,11 @@ func (s *UnitTestSuite) Test_AddLineItem_Success() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
@@ -201,9 +459,9 @@ func (s *UnitTestSuite) Test_AddLineItem_Success() {
 	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockEncodedValue, nil)
 
 	req := &AddLineItemRequest{
-		BillId: "1234",
+		BillId:      "1234",
 		Description: "item1",
-		Amount: 10.0,
+		Amount:      10.0,
 	}
 
 	resp, err := service.AddLineItem(ctx, req)
@@ -217,17 +475,18 @@ func (s *UnitTestSuite) Test_AddLineItem_SignalFail() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("error"))
 
 	req := &AddLineItemRequest{
-		BillId: "1234",
+		BillId:      "1234",
 		Description: "item1",
-		Amount: 10.0,
+		Amount:      10.0,
 	}
 
 	resp, err := service.AddLineItem(ctx, req)
@@ -241,19 +500,20 @@ func (s *UnitTestSuite) Test_AddLineItem_QueryFail() {
 	service := &Service{
 		client: mockClient,
 		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("error"))
 
 	req := &AddLineItemRequest{
-		BillId: "1234",
+		BillId:      "1234",
 		Description: "item1",
-		Amount: 10.0,
+		Amount:      10.0,
 	}
 
 	resp, err := service.AddLineItem(ctx, req)
@@ -270,16 +530,549 @@ func (s *UnitTestSuite) Test_AddLineItem_InvalidAmount() {
 		eb:     *errs.B(),
 	}
 
-	ctx := context.Background()
+	ctx := tenantContext(testTenant)
 
 	req := &AddLineItemRequest{
-		BillId: "1234",
+		BillId:      "1234",
 		Description: "item1",
-		Amount: -10.0,
+		Amount:      -10.0,
 	}
 
 	resp, err := service.AddLineItem(ctx, req)
 	s.Error(err)
 	s.Equal(err.Error(), "invalid_argument: amount must be greater than 0")
 	s.Nil(resp)
-}
\ No newline at end of file
+}
+
+func (s *UnitTestSuite) Test_CreateBill_LateFeePolicyWithoutDueDate() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	req := &CreateBillRequest{
+		CustomerId: testCustomer.Id,
+		Currency:   "USD",
+		LateFeePolicy: &workflow.LateFeePolicy{
+			FlatFee: 5.0,
+		},
+	}
+
+	resp, err := service.CreateBill(ctx, req)
+	s.Error(err)
+	s.EqualError(err, "invalid_argument: due date is required for a late fee policy")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_CreateBill_InvalidLateFeePolicy() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	due := time.Now().AddDate(0, 1, 0)
+	req := &CreateBillRequest{
+		CustomerId: testCustomer.Id,
+		Currency:   "USD",
+		DueDate:    &due,
+		LateFeePolicy: &workflow.LateFeePolicy{
+			InterestRate:   0.01,
+			InterestPeriod: "weekly",
+			MaxInterest:    10.0,
+		},
+	}
+
+	resp, err := service.CreateBill(ctx, req)
+	s.Error(err)
+	s.EqualError(err, "invalid_argument: interest period must be daily or monthly")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_GetBill_FromReadModel() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "GEL", TotalAmount: 5.0}),
+		eb:     *errs.B(),
+	}
+
+	bill, err := service.GetBill(tenantContext(testTenant), "1234", &GetBillParams{})
+	s.NoError(err)
+	s.Equal("GEL", bill.Currency)
+	s.Equal(5.0, bill.TotalAmount)
+}
+
+func (s *UnitTestSuite) Test_GetBills_ByStatus() {
+	closed := time.Now()
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store: newFakeBillStore(
+			workflow.Bill{Id: "1", Currency: "USD", CreatedAt: &closed},
+			workflow.Bill{Id: "2", Currency: "USD", CreatedAt: &closed, ClosedOn: &closed},
+		),
+		eb: *errs.B(),
+	}
+
+	resp, err := service.GetBills(tenantContext(testTenant), &GetBillsParams{Status: "closed"})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("2", resp.Bills[0].Id)
+
+	resp, err = service.GetBills(tenantContext(testTenant), &GetBillsParams{Status: "overdue"})
+	s.EqualError(err, "invalid_argument: invalid status parameter, use open or closed")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_GetBills_ByCurrencyAndCustomer() {
+	created := time.Now()
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store: newFakeBillStore(
+			workflow.Bill{Id: "1", Currency: "USD", CustomerId: "acme", CreatedAt: &created},
+			workflow.Bill{Id: "2", Currency: "GEL", CustomerId: "acme", CreatedAt: &created},
+			workflow.Bill{Id: "3", Currency: "GEL", CustomerId: "globex", CreatedAt: &created},
+		),
+		eb: *errs.B(),
+	}
+
+	resp, err := service.GetBills(tenantContext(testTenant), &GetBillsParams{Currency: "GEL", CustomerId: "acme"})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("2", resp.Bills[0].Id)
+}
+
+func (s *UnitTestSuite) Test_GetBills_UnsupportedCurrency() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	resp, err := service.GetBills(tenantContext(testTenant), &GetBillsParams{Currency: "EUR"})
+	s.EqualError(err, "invalid_argument: unsupported currency, only USD or GEL")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_BillVisibilityQuery_QuotesValues() {
+	query := billVisibilityQuery(billFilter{
+		Status:     "open",
+		Currency:   "USD",
+		CustomerId: `acme' OR WorkflowType != '\`,
+	})
+
+	s.Equal(`WorkflowType = 'BillWorkflow' AND ExecutionStatus = 'Running' AND (BillStatus = 'open' OR BillStatus IS NULL) AND BillCurrency = 'USD' AND BillCustomerId = 'acme\' OR WorkflowType != \'\\'`, query.String())
+}
+
+func (s *UnitTestSuite) Test_BillVisibilityQuery_ClosedBillsStillRunning() {
+	query := billVisibilityQuery(billFilter{Status: "closed"})
+
+	// The workflow of a closed bill runs until its late fees are charged
+	s.Equal(`WorkflowType = 'BillWorkflow' AND (ExecutionStatus = 'Completed' OR (ExecutionStatus = 'Running' AND BillStatus = 'closed'))`, query.String())
+}
+
+func (s *UnitTestSuite) Test_GetBills_ExpandLineItems() {
+	created := time.Now()
+	items := []workflow.LineItem{{Id: "item1", Description: "item1", Amount: 10.0, Type: workflow.LineItemFee}}
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store: newFakeBillStore(
+			workflow.Bill{Id: "1", Currency: "USD", LineItems: items, TotalAmount: 10.0, CreatedAt: &created},
+		),
+		eb: *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	// Summary rows by default
+	resp, err := service.GetBills(ctx, &GetBillsParams{})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal(1, resp.Bills[0].LineItemCount)
+	s.Equal(10.0, resp.Bills[0].TotalAmount)
+	s.Equal("open", resp.Bills[0].Status)
+	s.Nil(resp.Bills[0].LineItems)
+
+	resp, err = service.GetBills(ctx, &GetBillsParams{Expand: "lineItems"})
+	s.NoError(err)
+	s.Equal(items, resp.Bills[0].LineItems)
+
+	resp, err = service.GetBills(ctx, &GetBillsParams{Expand: "rejectedItems"})
+	s.EqualError(err, "invalid_argument: invalid expand parameter, use lineItems")
+	s.Nil(resp)
+}
+
+// The ranges and order are applied by the database, see Test_BillStore_ListBills_RangesAndSort
+func (s *UnitTestSuite) Test_GetBills_RangesAndSort() {
+	created := time.Date(2024, 9, 2, 9, 30, 0, 0, time.UTC)
+	store := newFakeBillStore(
+		workflow.Bill{Id: "1", Currency: "GEL", TotalAmount: 2500, CreatedAt: &created},
+		workflow.Bill{Id: "2", Currency: "GEL", TotalAmount: 1500, CreatedAt: &created},
+	)
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+	params := &GetBillsParams{
+		Currency:      "GEL",
+		CreatedAfter:  "2024-09-01T00:00:00Z",
+		CreatedBefore: "2024-09-08T00:00:00Z",
+		MinTotal:      1000,
+		Sort:          "totalAmount",
+		Order:         "desc",
+		PageSize:      1,
+	}
+
+	resp, err := service.GetBills(ctx, params)
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("1", resp.Bills[0].Id)
+
+	query := store.queries[0]
+	s.Equal(testTenant.Id, query.TenantId)
+	s.Equal("GEL", query.Currency)
+	s.True(query.CreatedAfter.Equal(time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)))
+	s.True(query.CreatedBefore.Equal(time.Date(2024, 9, 8, 0, 0, 0, 0, time.UTC)))
+	s.Equal(1000.0, query.MinTotal)
+	s.Equal(billSort{Field: sortByTotalAmount, Descending: true}, query.Sort)
+	s.Equal(2, query.Limit)
+	s.Nil(query.After)
+
+	// The next page starts after the last bill of this one
+	params.Cursor = resp.NextCursor
+	_, err = service.GetBills(ctx, params)
+	s.NoError(err)
+	s.Equal(&billCursor{Sort: query.Sort, CreatedAt: created, TotalAmount: 2500, Id: "1"}, store.queries[1].After)
+
+	// The cursor was issued for a different order
+	params.Order = "asc"
+	resp, err = service.GetBills(ctx, params)
+	s.EqualError(err, "invalid_argument: invalid cursor")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_GetBills_InvalidFilters() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	tests := []struct {
+		params *GetBillsParams
+		err    string
+	}{
+		{&GetBillsParams{CreatedAfter: "last week"}, "invalid_argument: invalid createdAfter parameter, use an RFC 3339 timestamp"},
+		{&GetBillsParams{ClosedAfter: "2024-09-08T00:00:00Z", ClosedBefore: "2024-09-01T00:00:00Z"}, "invalid_argument: closedAfter must be before closedBefore"},
+		{&GetBillsParams{MinTotal: -1}, "invalid_argument: totals must not be negative"},
+		{&GetBillsParams{MinTotal: 100, MaxTotal: 10}, "invalid_argument: minTotal must be less than maxTotal"},
+		{&GetBillsParams{Sort: "currency"}, "invalid_argument: invalid sort parameter, use createdAt or totalAmount"},
+		{&GetBillsParams{Order: "up"}, "invalid_argument: invalid order parameter, use asc or desc"},
+	}
+
+	for _, test := range tests {
+		resp, err := service.GetBills(ctx, test.params)
+		s.EqualError(err, test.err)
+		s.Nil(resp)
+	}
+}
+
+func (s *UnitTestSuite) Test_GetBills_Pagination() {
+	created := time.Date(2024, 9, 2, 9, 30, 0, 0, time.UTC)
+	store := newFakeBillStore(
+		workflow.Bill{Id: "a", Currency: "USD", CreatedAt: &created},
+		workflow.Bill{Id: "b", Currency: "USD", CreatedAt: &created},
+		workflow.Bill{Id: "c", Currency: "USD", CreatedAt: &created},
+	)
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	// One more bill than the page holds is fetched to tell there is another page
+	resp, err := service.GetBills(ctx, &GetBillsParams{PageSize: 2})
+	s.NoError(err)
+	s.Equal(3, store.queries[0].Limit)
+	s.Len(resp.Bills, 2)
+	s.Equal("b", resp.Bills[1].Id)
+	s.NotEmpty(resp.NextCursor)
+
+	_, err = service.GetBills(ctx, &GetBillsParams{PageSize: 2, Cursor: resp.NextCursor})
+	s.NoError(err)
+	s.Equal(&billCursor{Sort: billSort{Field: sortByCreatedAt}, CreatedAt: created, Id: "b"}, store.queries[1].After)
+
+	resp, err = service.GetBills(ctx, &GetBillsParams{PageSize: 3})
+	s.NoError(err)
+	s.Len(resp.Bills, 3)
+	s.Empty(resp.NextCursor)
+}
+
+func (s *UnitTestSuite) Test_GetBills_InvalidPage() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	resp, err := service.GetBills(ctx, &GetBillsParams{PageSize: 500})
+	s.EqualError(err, "invalid_argument: page size must be between 1 and 200")
+	s.Nil(resp)
+
+	resp, err = service.GetBills(ctx, &GetBillsParams{Cursor: "not-a-cursor"})
+	s.EqualError(err, "invalid_argument: invalid cursor")
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_RebuildBills_QueriesLatestRun() {
+	mockClient := mocks.NewClient(s.T())
+	store := newFakeBillStore()
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	mockClient.On("ListWorkflow", mock.Anything, mock.MatchedBy(func(req *workflowservice.ListWorkflowExecutionsRequest) bool {
+		return strings.Contains(req.Query, "ExecutionStatus != 'ContinuedAsNew'")
+	})).Return(&workflowservice.ListWorkflowExecutionsResponse{
+		Executions: []*temporalworkflow.WorkflowExecutionInfo{
+			{Execution: &common.WorkflowExecution{WorkflowId: "1234", RunId: "run1"}},
+		},
+	}, nil)
+
+	mockEncodedValue := &MockEncodedValue{}
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(mockEncodedValue, nil)
+
+	resp, err := service.RebuildBills(ctx, &RebuildBillsRequest{})
+	s.NoError(err)
+	s.Equal(1, resp.Rebuilt)
+	s.Equal(mockBill.TotalAmount, store.bills["1234"].TotalAmount)
+}
+
+func (s *UnitTestSuite) Test_RebuildBills_ReportsFailedBills() {
+	mockClient := mocks.NewClient(s.T())
+	store := newFakeBillStore()
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	timeout := rebuildQueryTimeout
+	rebuildQueryTimeout = 10 * time.Millisecond
+	defer func() { rebuildQueryTimeout = timeout }()
+
+	ctx := tenantContext(testTenant)
+
+	mockClient.On("ListWorkflow", mock.Anything, mock.Anything).Return(&workflowservice.ListWorkflowExecutionsResponse{
+		Executions: []*temporalworkflow.WorkflowExecutionInfo{
+			{Execution: &common.WorkflowExecution{WorkflowId: "1"}},
+			{Execution: &common.WorkflowExecution{WorkflowId: "2"}},
+			{Execution: &common.WorkflowExecution{WorkflowId: "3"}},
+		},
+	}, nil)
+
+	mockClient.On("QueryWorkflow", mock.Anything, "1", "", workflow.GetBill).Return(&MockEncodedValue{}, nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "2", "", workflow.GetBill).Return(nil, errors.New("error"))
+	mockClient.On("QueryWorkflow", mock.Anything, "3", "", workflow.GetBill).Run(func(args mock.Arguments) {
+		// A stuck worker only returns once the query times out
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil, context.DeadlineExceeded)
+
+	resp, err := service.RebuildBills(ctx, &RebuildBillsRequest{})
+	s.NoError(err)
+	s.Equal(1, resp.Rebuilt)
+	s.Equal([]FailedBill{
+		{Id: "2", Error: "internal: unable to query bill"},
+		{Id: "3", Error: "deadline_exceeded: timed out querying bill"},
+	}, resp.Failed)
+	s.Contains(store.bills, "1")
+}
+
+type MockBillValue struct {
+	bill workflow.Bill
+}
+
+func (m *MockBillValue) HasValue() bool {
+	return true
+}
+
+func (m *MockBillValue) Get(valuePtr interface{}) error {
+	*valuePtr.(*workflow.Bill) = m.bill
+	return nil
+}
+
+func (s *UnitTestSuite) Test_AddLineItem_ClosedBill() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(serviceerror.NewNotFound("workflow execution already completed"))
+	mockClient.On("DescribeWorkflowExecution", mock.Anything, "1234", "").Return(&workflowservice.DescribeWorkflowExecutionResponse{
+		WorkflowExecutionInfo: &temporalworkflow.WorkflowExecutionInfo{
+			Status: enums.WORKFLOW_EXECUTION_STATUS_COMPLETED,
+		},
+	}, nil)
+
+	req := &AddLineItemRequest{
+		BillId:      "1234",
+		Description: "item1",
+		Amount:      10.0,
+	}
+
+	resp, err := service.AddLineItem(ctx, req)
+	s.Error(err)
+	s.Equal("failed_precondition: bill is closed", err.Error())
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_AddLineItem_UnknownBill() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:  mockClient,
+		worker:  nil,
+		store:   newFakeBillStore(),
+		archive: &diskArchive{dir: s.T().TempDir()},
+		eb:      *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	// Unknown bills are not found before any signal is sent
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(nil, serviceerror.NewNotFound("workflow not found"))
+
+	req := &AddLineItemRequest{
+		BillId:      "1234",
+		Description: "item1",
+		Amount:      10.0,
+	}
+
+	resp, err := service.AddLineItem(ctx, req)
+	s.Error(err)
+	s.Equal("not_found: bill not found", err.Error())
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_AddLineItem_RejectedOnClose() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	var itemId string
+	mockClient.On("SignalWorkflow", mock.Anything, "1234", "", workflow.AddLineItem, mock.Anything).Run(func(args mock.Arguments) {
+		itemId = args.Get(4).(workflow.AddLineItemSignal).Id
+	}).Return(nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(func(ctx context.Context, workflowID string, runID string, queryType string, args ...interface{}) (converter.EncodedValue, error) {
+		return &MockBillValue{bill: workflow.Bill{
+			RejectedItems: []workflow.RejectedLineItem{
+				{LineItem: workflow.LineItem{Id: itemId}, Reason: "bill is closed"},
+			},
+		}}, nil
+	})
+
+	req := &AddLineItemRequest{
+		BillId:      "1234",
+		Description: "item1",
+		Amount:      10.0,
+	}
+
+	resp, err := service.AddLineItem(ctx, req)
+	s.Error(err)
+	s.Equal("failed_precondition: bill is closed", err.Error())
+	s.Nil(resp)
+}
+
+func (s *UnitTestSuite) Test_VoidLineItem_Success() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	voidedAt := time.Now()
+	mockClient.On("SignalWorkflow", mock.Anything, "1234", "", workflow.VoidLineItem, workflow.VoidLineItemSignal{ItemId: "item1", Reason: "charged twice"}).Return(nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "1234", "", workflow.GetBill).Return(&MockBillValue{bill: workflow.Bill{
+		TotalAmount: 5.0,
+		Version:     3,
+		LineItems: []workflow.LineItem{
+			{Id: "item1", Amount: 10.0, VoidedAt: &voidedAt, VoidReason: "charged twice"},
+			{Id: "item2", Amount: 5.0},
+		},
+	}}, nil)
+
+	resp, err := service.VoidLineItem(ctx, &VoidLineItemRequest{BillId: "1234", ItemId: "item1", Reason: "charged twice"})
+	s.NoError(err)
+	s.Equal(5.0, resp.CurrentTotal)
+	s.Equal(3, resp.Version)
+}
+
+func (s *UnitTestSuite) Test_VoidLineItem_UnknownItem() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(workflow.Bill{Id: "1234", Currency: "USD"}),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	mockClient.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("QueryWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&MockBillValue{bill: workflow.Bill{
+		LineItems: []workflow.LineItem{{Id: "item2", Amount: 5.0}},
+	}}, nil)
+
+	resp, err := service.VoidLineItem(ctx, &VoidLineItemRequest{BillId: "1234", ItemId: "item1"})
+	s.EqualError(err, "not_found: line item not found")
+	s.Nil(resp)
+
+	resp, err = service.VoidLineItem(ctx, &VoidLineItemRequest{BillId: "1234"})
+	s.EqualError(err, "invalid_argument: item id is required")
+	s.Nil(resp)
+}
@@ -0,0 +1,178 @@
+package fees
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+type GetBillDiffParams struct {
+	From string `query:"from"` // version, defaults to 0, the bill as created
+	To   string `query:"to"`   // version, defaults to the current version
+}
+
+// LineItemChange is a line item whose description, amount or type differs between the versions
+type LineItemChange struct {
+	Before workflow.LineItem `json:"before"`
+	After  workflow.LineItem `json:"after"`
+}
+
+// BillDiff lists how the line items of a bill changed from one version to another
+type BillDiff struct {
+	From            int                 `json:"from"`
+	To              int                 `json:"to"`
+	FromTotalAmount float64             `json:"fromTotalAmount"`
+	ToTotalAmount   float64             `json:"toTotalAmount"`
+	Added           []workflow.LineItem `json:"added"`
+	Changed         []LineItemChange    `json:"changed"`
+	Voided          []workflow.LineItem `json:"voided"` // includes items added and voided between the versions
+}
+
+// GetBillDiff compares the bill at two versions, both rebuilt from its ledger.
+// encore:api auth method=GET path=/api/bill/:id/diff
+func (s *Service) GetBillDiff(ctx context.Context, id string, params *GetBillDiffParams) (*BillDiff, error) {
+	from, err := s.parseVersion("from", params.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.parseVersion("to", params.To)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.billHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := events[len(events)-1].Sequence
+	if params.To == "" {
+		to = latest
+	}
+	if from > to {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("from must not be after to").Err()
+	}
+	if to > latest {
+		return nil, s.eb.Code(errs.NotFound).Msgf("bill version %d not found", to).Err()
+	}
+
+	before, _ := foldBillEvents(events, func(e workflow.BillEvent) bool { return e.Sequence <= from })
+	after, _ := foldBillEvents(events, func(e workflow.BillEvent) bool { return e.Sequence <= to })
+	return diffBills(before, after), nil
+}
+
+// getBillAt rebuilds the bill as it was at a point in time or at a version from its ledger
+func (s *Service) getBillAt(ctx context.Context, id string, params *GetBillParams) (*workflow.Bill, error) {
+	if params.AsOf != "" && params.Version != "" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("asOf and version cannot be combined").Err()
+	}
+
+	include := func(workflow.BillEvent) bool { return true }
+	var asOf *time.Time
+	if err := s.parseTimes(timeParam{"asOf", params.AsOf, &asOf}); err != nil {
+		return nil, err
+	}
+	if asOf != nil {
+		include = func(e workflow.BillEvent) bool { return !e.OccurredAt.After(*asOf) }
+	}
+
+	version := -1
+	if params.Version != "" {
+		var err error
+		if version, err = s.parseVersion("version", params.Version); err != nil {
+			return nil, err
+		}
+		include = func(e workflow.BillEvent) bool { return e.Sequence <= version }
+	}
+
+	events, err := s.billHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	bill, ok := foldBillEvents(events, include)
+	if !ok {
+		return nil, s.eb.Code(errs.NotFound).Msg("bill did not exist at that time").Err()
+	}
+	if version >= 0 && bill.Version != version {
+		return nil, s.eb.Code(errs.NotFound).Msgf("bill version %d not found", version).Err()
+	}
+	return bill, nil
+}
+
+// billHistory returns the events of the tenant's bill, bills started before the ledger existed have no history
+func (s *Service) billHistory(ctx context.Context, id string) ([]workflow.BillEvent, error) {
+	if _, err := s.tenantBill(ctx, id); err != nil {
+		return nil, err
+	}
+
+	events, err := s.store.ListEvents(ctx, id)
+	if err != nil {
+		rlog.Error("Error reading bill events", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill history").Err()
+	}
+	if len(events) == 0 {
+		return nil, s.eb.Code(errs.FailedPrecondition).Msg("bill history is not available, the bill predates the ledger").Err()
+	}
+	return events, nil
+}
+
+func (s *Service) parseVersion(name string, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, s.eb.Code(errs.InvalidArgument).Msgf("invalid %s parameter, use a bill version", name).Err()
+	}
+	return version, nil
+}
+
+// foldBillEvents applies the leading events of the ledger that are included, it reports false when
+// no event was applied. Events are in sequence order, so the first event left out ends the fold.
+func foldBillEvents(events []workflow.BillEvent, include func(workflow.BillEvent) bool) (*workflow.Bill, bool) {
+	bill := &workflow.Bill{}
+	applied := false
+	for _, event := range events {
+		if !include(event) {
+			break
+		}
+		bill.Apply(event)
+		applied = true
+	}
+	return bill, applied
+}
+
+func diffBills(before, after *workflow.Bill) *BillDiff {
+	diff := &BillDiff{
+		From:            before.Version,
+		To:              after.Version,
+		FromTotalAmount: before.TotalAmount,
+		ToTotalAmount:   after.TotalAmount,
+		Added:           make([]workflow.LineItem, 0),
+		Changed:         make([]LineItemChange, 0),
+		Voided:          make([]workflow.LineItem, 0),
+	}
+
+	previous := make(map[string]workflow.LineItem, len(before.LineItems))
+	for _, item := range before.LineItems {
+		previous[item.Id] = item
+	}
+
+	for _, item := range after.LineItems {
+		old, existed := previous[item.Id]
+		if !existed {
+			diff.Added = append(diff.Added, item)
+		} else if old.Description != item.Description || old.Amount != item.Amount || old.Type != item.Type {
+			diff.Changed = append(diff.Changed, LineItemChange{Before: old, After: item})
+		}
+		if item.VoidedAt != nil && (!existed || old.VoidedAt == nil) {
+			diff.Voided = append(diff.Voided, item)
+		}
+	}
+	return diff
+}
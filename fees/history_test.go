@@ -0,0 +1,158 @@
+package fees
+
+import (
+	"context"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/mocks"
+)
+
+// billHistoryService has bill 1234 with a ledger: created, two items added an hour apart, the first voided, then closed.
+// Bill 9999 was started by a subscription, it was created with two template items and had one added since.
+func (s *UnitTestSuite) billHistoryService() (*Service, time.Time) {
+	created := time.Date(2024, 9, 1, 9, 0, 0, 0, time.UTC)
+	store := newFakeBillStore(
+		workflow.Bill{Id: "1234", Currency: "USD"},
+		workflow.Bill{Id: "5678", Currency: "USD"},
+		workflow.Bill{Id: "9999", Currency: "USD"},
+	)
+
+	initial := workflow.Bill{Id: "1234", Currency: "USD", LineItems: []workflow.LineItem{}, CreatedAt: &created}
+	licence := workflow.LineItem{Id: "a", Description: "Licence", Amount: 100.0, Type: workflow.LineItemFee}
+	support := workflow.LineItem{Id: "b", Description: "Support", Amount: 20.0, Type: workflow.LineItemFee}
+	s.NoError(store.AppendEvents(context.Background(), []workflow.BillEvent{
+		{BillId: "1234", Sequence: 0, Type: workflow.EventCreated, OccurredAt: created, Bill: &initial},
+		{BillId: "1234", Sequence: 1, Type: workflow.EventItemAdded, OccurredAt: created.Add(time.Hour), Item: &licence},
+		{BillId: "1234", Sequence: 2, Type: workflow.EventItemAdded, OccurredAt: created.Add(2 * time.Hour), Item: &support},
+		{BillId: "1234", Sequence: 3, Type: workflow.EventItemVoided, OccurredAt: created.Add(3 * time.Hour), Item: &licence, Reason: "charged twice"},
+		{BillId: "1234", Sequence: 4, Type: workflow.EventClosed, OccurredAt: created.Add(4 * time.Hour)},
+	}))
+
+	scheduled := workflow.Bill{Id: "9999", Currency: "USD", SubscriptionId: "sub1", CreatedAt: &created, TotalAmount: 15.0, LineItems: []workflow.LineItem{
+		{Id: "template-1", Description: "Plan", Amount: 10.0, Type: workflow.LineItemFee},
+		{Id: "template-2", Description: "Seats", Amount: 5.0, Type: workflow.LineItemFee},
+	}}
+	extra := workflow.LineItem{Id: "c", Description: "Overage", Amount: 2.0, Type: workflow.LineItemFee}
+	s.NoError(store.AppendEvents(context.Background(), []workflow.BillEvent{
+		{BillId: "9999", Sequence: 0, Type: workflow.EventCreated, OccurredAt: created, Bill: &scheduled},
+		{BillId: "9999", Sequence: 1, Type: workflow.EventItemAdded, OccurredAt: created.Add(time.Hour), Item: &extra},
+	}))
+
+	return &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}, created
+}
+
+func (s *UnitTestSuite) Test_GetBill_AtVersion() {
+	service, _ := s.billHistoryService()
+	ctx := tenantContext(testTenant)
+
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{Version: "0"})
+	s.NoError(err)
+	s.Equal("1234", bill.Id)
+	s.Empty(bill.LineItems)
+	s.Equal(0.0, bill.TotalAmount)
+
+	bill, err = service.GetBill(ctx, "1234", &GetBillParams{Version: "3"})
+	s.NoError(err)
+	s.Equal(3, bill.Version)
+	s.Len(bill.LineItems, 2)
+	s.Equal(20.0, bill.TotalAmount)
+	s.NotNil(bill.LineItems[0].VoidedAt)
+	s.Nil(bill.ClosedOn)
+
+	_, err = service.GetBill(ctx, "1234", &GetBillParams{Version: "5"})
+	s.EqualError(err, "not_found: bill version 5 not found")
+}
+
+func (s *UnitTestSuite) Test_GetBill_AsOf() {
+	service, created := s.billHistoryService()
+	ctx := tenantContext(testTenant)
+
+	bill, err := service.GetBill(ctx, "1234", &GetBillParams{AsOf: created.Add(90 * time.Minute).Format(time.RFC3339)})
+	s.NoError(err)
+	s.Equal(1, bill.Version)
+	s.Equal(100.0, bill.TotalAmount)
+
+	bill, err = service.GetBill(ctx, "1234", &GetBillParams{AsOf: created.Add(24 * time.Hour).Format(time.RFC3339)})
+	s.NoError(err)
+	s.Equal(4, bill.Version)
+	s.NotNil(bill.ClosedOn)
+
+	_, err = service.GetBill(ctx, "1234", &GetBillParams{AsOf: created.Add(-time.Hour).Format(time.RFC3339)})
+	s.EqualError(err, "not_found: bill did not exist at that time")
+}
+
+func (s *UnitTestSuite) Test_GetBill_InvalidPointInTime() {
+	service, _ := s.billHistoryService()
+	ctx := tenantContext(testTenant)
+
+	_, err := service.GetBill(ctx, "1234", &GetBillParams{AsOf: "2024-09-01", Version: "1"})
+	s.EqualError(err, "invalid_argument: asOf and version cannot be combined")
+
+	_, err = service.GetBill(ctx, "1234", &GetBillParams{AsOf: "2024-09-01"})
+	s.EqualError(err, "invalid_argument: invalid asOf parameter, use an RFC 3339 timestamp")
+
+	_, err = service.GetBill(ctx, "1234", &GetBillParams{Version: "-1"})
+	s.EqualError(err, "invalid_argument: invalid version parameter, use a bill version")
+
+	// Bills started before the ledger existed have no history to rebuild
+	_, err = service.GetBill(ctx, "5678", &GetBillParams{Version: "0"})
+	s.EqualError(err, "failed_precondition: bill history is not available, the bill predates the ledger")
+}
+
+func (s *UnitTestSuite) Test_GetBillDiff() {
+	service, _ := s.billHistoryService()
+	ctx := tenantContext(testTenant)
+
+	diff, err := service.GetBillDiff(ctx, "1234", &GetBillDiffParams{From: "1"})
+	s.NoError(err)
+	s.Equal(1, diff.From)
+	s.Equal(4, diff.To)
+	s.Equal(100.0, diff.FromTotalAmount)
+	s.Equal(20.0, diff.ToTotalAmount)
+	s.Len(diff.Added, 1)
+	s.Equal("b", diff.Added[0].Id)
+	s.Empty(diff.Changed)
+	s.Len(diff.Voided, 1)
+	s.Equal("a", diff.Voided[0].Id)
+	s.Equal("charged twice", diff.Voided[0].VoidReason)
+
+	// Items added and voided between the versions are listed as both
+	diff, err = service.GetBillDiff(ctx, "1234", &GetBillDiffParams{To: "3"})
+	s.NoError(err)
+	s.Len(diff.Added, 2)
+	s.Len(diff.Voided, 1)
+
+	_, err = service.GetBillDiff(ctx, "1234", &GetBillDiffParams{From: "3", To: "1"})
+	s.EqualError(err, "invalid_argument: from must not be after to")
+
+	_, err = service.GetBillDiff(ctx, "1234", &GetBillDiffParams{To: "9"})
+	s.EqualError(err, "not_found: bill version 9 not found")
+}
+
+func (s *UnitTestSuite) Test_BillHistory_SubscriptionTemplates() {
+	service, _ := s.billHistoryService()
+	ctx := tenantContext(testTenant)
+
+	// The bill as created holds the template items
+	bill, err := service.GetBill(ctx, "9999", &GetBillParams{Version: "0"})
+	s.NoError(err)
+	s.Equal(0, bill.Version)
+	s.Len(bill.LineItems, 2)
+	s.Equal(15.0, bill.TotalAmount)
+
+	diff, err := service.GetBillDiff(ctx, "9999", &GetBillDiffParams{})
+	s.NoError(err)
+	s.Equal(0, diff.From)
+	s.Equal(1, diff.To)
+	s.Equal(15.0, diff.FromTotalAmount)
+	s.Equal(17.0, diff.ToTotalAmount)
+	s.Len(diff.Added, 1)
+	s.Equal("c", diff.Added[0].Id)
+}
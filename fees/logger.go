@@ -0,0 +1,22 @@
+package fees
+
+import "encore.dev/rlog"
+
+// temporalLogger sends the Temporal client, worker and workflow logs to rlog
+type temporalLogger struct{}
+
+func (temporalLogger) Debug(msg string, keyvals ...interface{}) {
+	rlog.Debug(msg, keyvals...)
+}
+
+func (temporalLogger) Info(msg string, keyvals ...interface{}) {
+	rlog.Info(msg, keyvals...)
+}
+
+func (temporalLogger) Warn(msg string, keyvals ...interface{}) {
+	rlog.Warn(msg, keyvals...)
+}
+
+func (temporalLogger) Error(msg string, keyvals ...interface{}) {
+	rlog.Error(msg, keyvals...)
+}
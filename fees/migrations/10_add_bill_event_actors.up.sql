@@ -0,0 +1,5 @@
+-- The principal that made each change, kept beside the event data so the audit trail can be filtered by it.
+-- Events recorded before actors existed, and late fees charged by the workflow, have none.
+ALTER TABLE bill_events ADD COLUMN actor TEXT;
+CREATE INDEX bill_events_actor_idx ON bill_events (actor, occurred_at);
+CREATE INDEX bill_events_occurred_at_idx ON bill_events (occurred_at);
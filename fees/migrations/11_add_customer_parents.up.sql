@@ -0,0 +1,4 @@
+-- Customers can be the child account of a parent, whose bill consolidates theirs at the end of a period.
+-- The hierarchy is a single level deep, parents have no parent of their own.
+ALTER TABLE customers ADD COLUMN parent_id TEXT REFERENCES customers (id);
+CREATE INDEX customers_parent_id_idx ON customers (tenant_id, parent_id);
@@ -0,0 +1,8 @@
+-- Voided line items stay on the bill but are left out of search
+ALTER TABLE bill_line_items ADD COLUMN voided_at TIMESTAMPTZ;
+
+UPDATE bill_line_items items SET voided_at = (item.value->>'voidedAt')::TIMESTAMPTZ
+FROM bills, jsonb_array_elements(
+    CASE jsonb_typeof(bills.data->'lineItems') WHEN 'array' THEN bills.data->'lineItems' ELSE '[]'::jsonb END
+) WITH ORDINALITY AS item (value, position)
+WHERE bills.id = items.bill_id AND item.position = items.position AND item.value->>'voidedAt' IS NOT NULL;
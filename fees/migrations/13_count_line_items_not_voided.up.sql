@@ -0,0 +1,7 @@
+-- Voided line items stay on the bill but are no longer counted
+UPDATE bills SET line_item_count = (
+    SELECT COUNT(*) FROM jsonb_array_elements(
+        CASE jsonb_typeof(bills.data->'lineItems') WHEN 'array' THEN bills.data->'lineItems' ELSE '[]'::jsonb END
+    ) AS item (value)
+    WHERE item.value->>'voidedAt' IS NULL
+);
@@ -0,0 +1,14 @@
+-- Read model of the bill workflows, projected by the workflow on every change
+CREATE TABLE bills (
+    id TEXT PRIMARY KEY,
+    currency TEXT NOT NULL,
+    status TEXT NOT NULL,
+    total_amount DOUBLE PRECISION NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMPTZ,
+    closed_on TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX bills_status_idx ON bills (status);
+CREATE INDEX bills_created_at_idx ON bills (created_at);
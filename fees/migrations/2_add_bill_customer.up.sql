@@ -0,0 +1,7 @@
+-- Bills can be filtered by the customer they were raised against
+ALTER TABLE bills ADD COLUMN customer_id TEXT NOT NULL DEFAULT '';
+
+UPDATE bills SET customer_id = COALESCE(data->>'customerId', '');
+
+CREATE INDEX bills_customer_id_idx ON bills (customer_id);
+CREATE INDEX bills_currency_idx ON bills (currency);
@@ -0,0 +1,7 @@
+-- Bills are listed as summary rows without decoding their data
+ALTER TABLE bills ADD COLUMN line_item_count INTEGER NOT NULL DEFAULT 0;
+
+UPDATE bills SET line_item_count = CASE jsonb_typeof(data->'lineItems')
+    WHEN 'array' THEN jsonb_array_length(data->'lineItems')
+    ELSE 0
+END;
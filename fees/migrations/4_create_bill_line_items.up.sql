@@ -0,0 +1,22 @@
+-- Line items of every bill, indexed for full-text search on their description.
+-- Items are keyed by their position, line items added before item ids existed have none.
+CREATE TABLE bill_line_items (
+    bill_id TEXT NOT NULL REFERENCES bills (id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    id TEXT NOT NULL,
+    description TEXT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    type TEXT NOT NULL,
+    created_at TIMESTAMPTZ,
+    search TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', description)) STORED,
+    PRIMARY KEY (bill_id, position)
+);
+
+CREATE INDEX bill_line_items_search_idx ON bill_line_items USING GIN (search);
+
+INSERT INTO bill_line_items (bill_id, position, id, description, amount, type, created_at)
+SELECT bills.id, item.position, COALESCE(item.value->>'id', ''), COALESCE(item.value->>'description', ''),
+    (item.value->>'amount')::DOUBLE PRECISION, COALESCE(item.value->>'type', ''), (item.value->>'createdAt')::TIMESTAMPTZ
+FROM bills, jsonb_array_elements(
+    CASE jsonb_typeof(bills.data->'lineItems') WHEN 'array' THEN bills.data->'lineItems' ELSE '[]'::jsonb END
+) WITH ORDINALITY AS item (value, position);
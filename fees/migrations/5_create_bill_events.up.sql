@@ -0,0 +1,21 @@
+-- Ledger of every change to a bill, numbered by the bill version the change produced.
+-- Events are append only, they are never updated or deleted.
+CREATE TABLE bill_events (
+    bill_id TEXT NOT NULL,
+    sequence INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    data JSONB NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (bill_id, sequence)
+);
+
+CREATE FUNCTION reject_bill_event_changes() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'bill events are append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER bill_events_append_only
+    BEFORE UPDATE OR DELETE ON bill_events
+    FOR EACH ROW EXECUTE FUNCTION reject_bill_event_changes();
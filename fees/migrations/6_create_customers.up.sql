@@ -0,0 +1,12 @@
+-- Customers that bills are raised against
+CREATE TABLE customers (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    billing_address JSONB NOT NULL,
+    default_currency TEXT NOT NULL,
+    tax_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX customers_name_idx ON customers (name, id);
@@ -0,0 +1,18 @@
+-- Tenants isolate bills, customers and subscriptions, and hold their own configuration
+CREATE TABLE tenants (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    allowed_currencies TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Bills and customers from before tenants existed belong to the default tenant
+INSERT INTO tenants (id, name, allowed_currencies) VALUES ('default', 'Default', ARRAY['USD', 'GEL']);
+
+ALTER TABLE bills ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX bills_tenant_id_idx ON bills (tenant_id, created_at);
+
+ALTER TABLE customers ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+DROP INDEX customers_name_idx;
+CREATE INDEX customers_name_idx ON customers (tenant_id, name, id);
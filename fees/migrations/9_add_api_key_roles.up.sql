@@ -0,0 +1,2 @@
+-- Roles limit the bill operations a key can perform, keys created before roles existed keep their access
+ALTER TABLE api_keys ADD COLUMN role TEXT NOT NULL DEFAULT 'admin';
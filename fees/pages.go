@@ -0,0 +1,95 @@
+package fees
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// Listings are returned a page at a time. The cursor of the next page is the position of the last item of the
+// page in the listing order, and one more item than the page holds is fetched to tell whether there is another page.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// pageCursor is the position of an item in a listing order, encoded as base64 JSON
+type pageCursor interface {
+	// complete reports whether the cursor has every field the position needs
+	complete() bool
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string, c pageCursor) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return err
+	}
+	if !c.complete() {
+		return errors.New("cursor is incomplete")
+	}
+	return nil
+}
+
+// parsePage validates the page size, zero for the default, and decodes the cursor of the previous page into after.
+// It reports whether there was a cursor, after is left as it is when there is none.
+func (s *Service) parsePage(pageSize int, cursor string, after pageCursor) (int, bool, error) {
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize < 0 || pageSize > maxPageSize {
+		return 0, false, s.eb.Code(errs.InvalidArgument).Msgf("page size must be between 1 and %d", maxPageSize).Err()
+	}
+	if cursor == "" {
+		return pageSize, false, nil
+	}
+	if err := decodeCursor(cursor, after); err != nil {
+		return 0, false, s.eb.Code(errs.InvalidArgument).Msg("invalid cursor").Err()
+	}
+	return pageSize, true, nil
+}
+
+// trimPage drops the extra item fetched beyond the page, reporting whether there is another page
+func trimPage[T any](items []T, pageSize int) ([]T, bool) {
+	if len(items) > pageSize {
+		return items[:pageSize], true
+	}
+	return items, false
+}
+
+// cursorTime is a timestamp as Postgres stores it, with microsecond precision, so the next page starts right after it
+func cursorTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond)
+}
+
+// timeParam is an optional RFC 3339 query parameter
+type timeParam struct {
+	name  string
+	value string
+	dest  **time.Time
+}
+
+// parseTimes parses the parameters that are set into their destinations
+func (s *Service) parseTimes(params ...timeParam) error {
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, p.value)
+		if err != nil {
+			return s.eb.Code(errs.InvalidArgument).Msgf("invalid %s parameter, use an RFC 3339 timestamp", p.name).Err()
+		}
+		*p.dest = &parsed
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package fees
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"go.temporal.io/api/workflowservice/v1"
+)
+
+// RebuildBillsRequest limits the rebuild to matching bills, all bills are rebuilt when it is empty.
+// Currency and customer filters only match bills that index search attributes.
+type RebuildBillsRequest struct {
+	Status     string `json:"status"` // open, closed
+	Currency   string `json:"currency"`
+	CustomerId string `json:"customerId"`
+}
+
+type RebuildBillsResponse struct {
+	Rebuilt int          `json:"rebuilt"`
+	Failed  []FailedBill `json:"failed"` // bills left as they were in the read model
+}
+
+type FailedBill struct {
+	Id    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Bills are queried concurrently, each query is bounded so a slow worker cannot stall the rebuild
+var (
+	rebuildConcurrency  = 10
+	rebuildQueryTimeout = 5 * time.Second
+)
+
+// RebuildBills repopulates the bills read model from the state of every bill workflow of the tenant.
+// It needs a key with the admin scope and role.
+// encore:api auth method=POST path=/api/bills/rebuild
+func (s *Service) RebuildBills(ctx context.Context, req *RebuildBillsRequest) (*RebuildBillsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := billFilter{TenantId: tenant.Id, Status: req.Status, Currency: req.Currency, CustomerId: req.CustomerId}
+	if err := s.validateBillFilter(tenant, filter); err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Rebuilding bills read model", "filter", filter)
+
+	options := &workflowservice.ListWorkflowExecutionsRequest{
+		Query: billVisibilityQuery(filter).String(),
+	}
+
+	res := &RebuildBillsResponse{Failed: make([]FailedBill, 0)}
+	for {
+		page, err := s.client.ListWorkflow(ctx, options)
+		if err != nil {
+			rlog.Error("Error listing workflows", "error", err)
+			return nil, s.eb.Code(errs.Internal).Msg("unable to list bills").Err()
+		}
+
+		ids := make([]string, len(page.Executions))
+		for i, e := range page.Executions {
+			ids[i] = e.GetExecution().WorkflowId
+		}
+
+		for i, err := range s.rebuildBills(ctx, tenant.Id, ids) {
+			if err != nil {
+				res.Failed = append(res.Failed, FailedBill{Id: ids[i], Error: err.Error()})
+				continue
+			}
+			res.Rebuilt++
+		}
+
+		if len(page.NextPageToken) == 0 {
+			break
+		}
+		options.NextPageToken = page.NextPageToken
+	}
+
+	rlog.Info("Rebuilt bills read model", "rebuilt", res.Rebuilt, "failed", len(res.Failed))
+	return res, nil
+}
+
+// rebuildBills rebuilds the bills concurrently, returning the error for each bill in the same order
+func (s *Service) rebuildBills(ctx context.Context, tenantId string, ids []string) []error {
+	results := make([]error, len(ids))
+	sem := make(chan struct{}, rebuildConcurrency)
+	var wg sync.WaitGroup
+
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.rebuildBill(ctx, tenantId, id)
+		}(i, id)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func (s *Service) rebuildBill(ctx context.Context, tenantId string, workflowID string) error {
+	// Builders are modified by every call, so each bill needs its own copy
+	eb := s.eb
+
+	queryCtx, cancel := context.WithTimeout(ctx, rebuildQueryTimeout)
+	defer cancel()
+
+	// Query the latest run for the bill details, the listed run may have continued as new since
+	queryRes, err := s.client.QueryWorkflow(queryCtx, workflowID, "", workflow.GetBill)
+	if err != nil {
+		rlog.Error("Error querying workflow", "workflowID", workflowID, "error", err)
+		if queryCtx.Err() == context.DeadlineExceeded {
+			return eb.Code(errs.DeadlineExceeded).Msg("timed out querying bill").Err()
+		}
+		return eb.Code(errs.Internal).Msg("unable to query bill").Err()
+	}
+
+	var bill workflow.Bill
+	if err := queryRes.Get(&bill); err != nil {
+		rlog.Error("Error getting query result", "workflowID", workflowID, "error", err)
+		return eb.Code(errs.Internal).Msg("unable to read bill").Err()
+	}
+
+	// The visibility query already matches the tenant, this guards bills that index stale search attributes
+	if billTenant(&bill) != tenantId {
+		rlog.Warn("Skipping bill of another tenant", "workflowID", workflowID, "tenant", tenantId)
+		return eb.Code(errs.NotFound).Msg("bill not found").Err()
+	}
+
+	bill.Id = workflowID
+	if err := s.store.SaveBill(ctx, bill); err != nil {
+		rlog.Error("Error saving bill", "workflowID", workflowID, "error", err)
+		return eb.Code(errs.Internal).Msg("unable to save bill").Err()
+	}
+	return nil
+}
+
+// billVisibilityQuery lists the latest run of every bill matching the filter
+func billVisibilityQuery(filter billFilter) *visibilityQuery {
+	q := &visibilityQuery{}
+	q.equals("WorkflowType", "BillWorkflow")
+
+	// Runs that continued as new are superseded by a later run of the same bill.
+	// Status is matched on the execution so bills started before search attributes were indexed are included.
+	// Closed bills keep running while late fees are left to charge, which their indexed status tells apart.
+	status := workflow.StatusKey.GetName()
+	switch filter.Status {
+	case workflow.StatusOpen:
+		q.add("ExecutionStatus = %s AND ("+status+" = %s OR "+status+" IS NULL)", "Running", workflow.StatusOpen)
+	case workflow.StatusClosed:
+		q.add("(ExecutionStatus = %s OR (ExecutionStatus = %s AND "+status+" = %s))", "Completed", "Running", workflow.StatusClosed)
+	default:
+		q.add("ExecutionStatus != %s", "ContinuedAsNew")
+	}
+
+	q.tenant(filter.TenantId)
+
+	q.equals(workflow.CurrencyKey.GetName(), filter.Currency)
+	q.equals(workflow.CustomerIdKey.GetName(), filter.CustomerId)
+	return q
+}
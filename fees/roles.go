@@ -0,0 +1,120 @@
+package fees
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// Roles grant the operations a caller can perform on bills, customers and subscriptions
+const (
+	RoleViewer   = "viewer"
+	RoleBiller   = "biller"
+	RoleApprover = "approver"
+	RoleAdmin    = "admin"
+)
+
+// operation is what an endpoint does, it is named so it reads in denial messages
+type operation string
+
+const (
+	opView                operation = "view bills"
+	opCreateBill          operation = "create bills"
+	opAddItem             operation = "add items"
+	opVoidItem            operation = "void items"
+	opClose               operation = "close bills"
+	opManageCustomers     operation = "manage customers"
+	opManageSubscriptions operation = "manage subscriptions"
+	opManageKeys          operation = "manage keys"
+	opRebuild             operation = "rebuild bills"
+	opAudit               operation = "view the audit trail"
+)
+
+// Billers raise bills while approvers settle them, so nobody but an admin can both add and void items
+var roleOperations = map[string][]operation{
+	RoleViewer:   {opView},
+	RoleBiller:   {opView, opCreateBill, opAddItem, opManageCustomers, opManageSubscriptions},
+	RoleApprover: {opView, opVoidItem, opClose, opAudit},
+	RoleAdmin: {opView, opCreateBill, opAddItem, opVoidItem, opClose,
+		opManageCustomers, opManageSubscriptions, opManageKeys, opRebuild, opAudit},
+}
+
+// scopeOperations are the operations each API key scope allows, the role of the key must allow them as well
+var scopeOperations = map[string][]operation{
+	ScopeRead:  {opView, opAudit},
+	ScopeWrite: {opCreateBill, opAddItem, opVoidItem, opManageCustomers, opManageSubscriptions},
+	ScopeClose: {opClose},
+	ScopeAdmin: roleOperations[RoleAdmin],
+}
+
+// endpointOperations is the operation of each authenticated endpoint, endpoints missing from it are denied
+var endpointOperations = map[string]operation{
+	"GetBill":              opView,
+	"GetBills":             opView,
+	"GetBillStats":         opView,
+	"SearchBills":          opView,
+	"GetBillEvents":        opView,
+	"GetBillDiff":          opView,
+	"GetCustomer":          opView,
+	"GetCustomers":         opView,
+	"GetCustomerBills":     opView,
+	"GetChildCustomers":    opView,
+	"GetSubscription":      opView,
+	"GetSubscriptions":     opView,
+	"GetSubscriptionBills": opView,
+	"GetAudit":             opAudit,
+
+	"CreateBill":       opCreateBill,
+	"ConsolidateBills": opCreateBill,
+	"AddLineItem":      opAddItem,
+	"VoidLineItem":     opVoidItem,
+	"CloseBill":        opClose,
+
+	"CreateCustomer":     opManageCustomers,
+	"UpdateCustomer":     opManageCustomers,
+	"CreateSubscription": opManageSubscriptions,
+	"PauseSubscription":  opManageSubscriptions,
+	"ResumeSubscription": opManageSubscriptions,
+	"CancelSubscription": opManageSubscriptions,
+
+	"CreateApiKey": opManageKeys,
+	"GetApiKeys":   opManageKeys,
+	"RevokeApiKey": opManageKeys,
+	"RebuildBills": opRebuild,
+}
+
+var roles = []string{RoleViewer, RoleBiller, RoleApprover, RoleAdmin}
+
+func grants(operations []operation, op operation) bool {
+	for _, o := range operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the key can call the endpoint and resolves the tenant it was issued for.
+// It runs in TenantMiddleware, so denied requests never reach the handler or Temporal.
+func (s *Service) authorize(ctx context.Context, endpoint string, key *AuthData) (*Tenant, error) {
+	if key == nil {
+		return nil, s.eb.Code(errs.Unauthenticated).Msg("an api key is required").Err()
+	}
+
+	op, ok := endpointOperations[endpoint]
+	if !ok {
+		rlog.Error("Endpoint has no operation", "endpoint", endpoint)
+		return nil, s.eb.Code(errs.PermissionDenied).Msg("endpoint is not available to api keys").Err()
+	}
+	if !key.scoped(op) {
+		rlog.Warn("Api key is not scoped to the operation", "id", key.KeyId, "tenant", key.TenantId, "endpoint", endpoint, "operation", op, "scopes", key.Scopes)
+		return nil, s.eb.Code(errs.PermissionDenied).Msgf("api key is not scoped to %s", op).Err()
+	}
+	if !grants(roleOperations[key.Role], op) {
+		rlog.Warn("Role does not allow the operation", "id", key.KeyId, "tenant", key.TenantId, "endpoint", endpoint, "operation", op, "role", key.Role)
+		return nil, s.eb.Code(errs.PermissionDenied).Msgf("the %s role cannot %s", key.Role, op).Err()
+	}
+
+	return s.resolveTenant(ctx, key.TenantId)
+}
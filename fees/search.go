@@ -0,0 +1,83 @@
+package fees
+
+import (
+	"context"
+	"strings"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+type SearchBillsParams struct {
+	Query string `query:"q"`     // words or "quoted phrases" in the line item description
+	Limit int    `query:"limit"` // matching line items, defaults to 50, at most 200
+}
+
+// LineItemMatch is a line item whose description matched. The highlight is the description as escaped HTML,
+// with the matched words wrapped in <mark> tags.
+type LineItemMatch struct {
+	Id          string  `json:"id"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+	Type        string  `json:"type"`
+	Highlight   string  `json:"highlight"`
+}
+
+type BillSearchResult struct {
+	BillId   string          `json:"billId"`
+	Currency string          `json:"currency"`
+	Status   string          `json:"status"`
+	Items    []LineItemMatch `json:"items"`
+}
+
+type SearchBillsResponse struct {
+	Bills []BillSearchResult `json:"bills"` // best matches first
+}
+
+// SearchBills finds the bills with line items matching the query.
+// encore:api auth method=GET path=/api/bills/search
+func (s *Service) SearchBills(ctx context.Context, params *SearchBillsParams) (*SearchBillsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSpace(params.Query)
+	if text == "" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("search query is required").Err()
+	}
+
+	limit := params.Limit
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 0 || limit > maxPageSize {
+		return nil, s.eb.Code(errs.InvalidArgument).Msgf("limit must be between 1 and %d", maxPageSize).Err()
+	}
+
+	matches, err := s.store.SearchLineItems(ctx, tenant.Id, text, limit)
+	if err != nil {
+		rlog.Error("Error searching line items", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to search bills").Err()
+	}
+
+	// Bills are ordered by their best matching line item
+	res := &SearchBillsResponse{Bills: make([]BillSearchResult, 0)}
+	positions := make(map[string]int)
+	for _, m := range matches {
+		i, ok := positions[m.BillId]
+		if !ok {
+			i = len(res.Bills)
+			positions[m.BillId] = i
+			res.Bills = append(res.Bills, BillSearchResult{BillId: m.BillId, Currency: m.Currency, Status: m.Status})
+		}
+		res.Bills[i].Items = append(res.Bills[i].Items, LineItemMatch{
+			Id:          m.Item.Id,
+			Description: m.Item.Description,
+			Amount:      m.Item.Amount,
+			Type:        m.Item.Type,
+			Highlight:   m.Highlight,
+		})
+	}
+	return res, nil
+}
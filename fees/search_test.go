@@ -0,0 +1,64 @@
+package fees
+
+import (
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/mocks"
+)
+
+func (s *UnitTestSuite) Test_SearchBills_GroupsItemsByBill() {
+	store := newFakeBillStore()
+	match := func(billId, currency, itemId, description string) lineItemMatch {
+		return lineItemMatch{
+			BillId:    billId,
+			Currency:  currency,
+			Status:    workflow.StatusOpen,
+			Item:      workflow.LineItem{Id: itemId, Description: description, Type: workflow.LineItemFee},
+			Highlight: description,
+		}
+	}
+	// Best matches first, as the database ranks them
+	store.matches = []lineItemMatch{
+		match("1", "USD", "a", "Annual <mark>licence</mark>"),
+		match("2", "GEL", "d", "Monthly <mark>licence</mark>"),
+		match("1", "USD", "c", "<mark>Licence</mark> upgrade"),
+	}
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	resp, err := service.SearchBills(tenantContext(testTenant), &SearchBillsParams{Query: "licence"})
+	s.NoError(err)
+	s.Len(resp.Bills, 2)
+
+	s.Equal("1", resp.Bills[0].BillId)
+	s.Len(resp.Bills[0].Items, 2)
+	s.Equal("a", resp.Bills[0].Items[0].Id)
+	s.Equal("Annual <mark>licence</mark>", resp.Bills[0].Items[0].Highlight)
+	s.Equal("c", resp.Bills[0].Items[1].Id)
+
+	s.Equal("2", resp.Bills[1].BillId)
+	s.Equal("GEL", resp.Bills[1].Currency)
+}
+
+func (s *UnitTestSuite) Test_SearchBills_InvalidParams() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	ctx := tenantContext(testTenant)
+
+	resp, err := service.SearchBills(ctx, &SearchBillsParams{Query: "  "})
+	s.EqualError(err, "invalid_argument: search query is required")
+	s.Nil(resp)
+
+	resp, err = service.SearchBills(ctx, &SearchBillsParams{Query: "licence", Limit: 1000})
+	s.EqualError(err, "invalid_argument: limit must be between 1 and 200")
+	s.Nil(resp)
+}
@@ -15,13 +15,19 @@ var billTaskQueue = "BILL_TASK_QUEUE"
 
 //encore:service
 type Service struct {
-	client client.Client
-	worker worker.Worker
-	eb     errs.Builder
+	client  client.Client
+	worker  worker.Worker
+	store   billRepository
+	customers customerRepository
+	tenants tenantRepository
+	apiKeys apiKeyRepository
+	cache   *billCache
+	archive billArchive
+	eb      errs.Builder
 }
 
 func initService() (*Service, error) {
-	c, err := client.Dial(client.Options{})
+	c, err := client.Dial(client.Options{Logger: temporalLogger{}})
 	if err != nil {
 		return nil, fmt.Errorf("unable to create temporal client: %v", err)
 	}
@@ -30,7 +36,15 @@ func initService() (*Service, error) {
 
 	w := worker.New(c, billTaskQueue, worker.Options{})
 
+	store := &billStore{db: db}
+	archive, err := newDiskArchive()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to open bill archive: %v", err)
+	}
+
 	w.RegisterWorkflow(workflow.BillWorkflow)
+	w.RegisterActivity(&workflow.Activities{Store: store, Archive: archive, Ledger: store})
 
 	err = w.Start()
 	if err != nil {
@@ -40,7 +54,7 @@ func initService() (*Service, error) {
 
 	rlog.Info("Started worker for bill workflow")
 
-	return &Service{client: c, worker: w, eb: *errs.B()}, nil
+	return &Service{client: c, worker: w, store: store, customers: &customerStore{db: db}, tenants: &tenantStore{db: db}, apiKeys: &apiKeyStore{db: db}, cache: newBillCache(), archive: archive, eb: *errs.B()}, nil
 }
 
 func (s *Service) Shutdown(force context.Context) {
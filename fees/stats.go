@@ -0,0 +1,73 @@
+package fees
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// GetBillStatsParams filters the bills counted, the same way as GetBillsParams
+type GetBillStatsParams struct {
+	Status        string  `query:"status"` // open, closed
+	Currency      string  `query:"currency"`
+	CustomerId    string  `query:"customerId"`
+	CreatedAfter  string  `query:"createdAfter"`  // RFC 3339, inclusive
+	CreatedBefore string  `query:"createdBefore"` // RFC 3339, exclusive
+	ClosedAfter   string  `query:"closedAfter"`   // RFC 3339, inclusive
+	ClosedBefore  string  `query:"closedBefore"`  // RFC 3339, exclusive
+	MinTotal      float64 `query:"minTotal"`      // inclusive
+	MaxTotal      float64 `query:"maxTotal"`      // exclusive, zero for no upper bound
+}
+
+// BillStats counts the bills with a status and currency, totals are only summed within a currency
+type BillStats struct {
+	Status      string  `json:"status"`
+	Currency    string  `json:"currency"`
+	Count       int     `json:"count"`
+	TotalAmount float64 `json:"totalAmount"`
+}
+
+type GetBillStatsResponse struct {
+	Count  int         `json:"count"`
+	Groups []BillStats `json:"groups"`
+}
+
+func (p *GetBillStatsParams) filterParams() billFilterParams {
+	return billFilterParams{
+		Status:        p.Status,
+		Currency:      p.Currency,
+		CustomerId:    p.CustomerId,
+		CreatedAfter:  p.CreatedAfter,
+		CreatedBefore: p.CreatedBefore,
+		ClosedAfter:   p.ClosedAfter,
+		ClosedBefore:  p.ClosedBefore,
+		MinTotal:      p.MinTotal,
+		MaxTotal:      p.MaxTotal,
+	}
+}
+
+// GetBillStats counts the matching bills and sums their totals, grouped by status and currency.
+// encore:api auth method=GET path=/api/bills/stats
+func (s *Service) GetBillStats(ctx context.Context, params *GetBillStatsParams) (*GetBillStatsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.parseBillFilter(tenant, params.filterParams())
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := s.store.AggregateBills(ctx, filter)
+	if err != nil {
+		rlog.Error("Error aggregating bills", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get bill stats").Err()
+	}
+
+	res := &GetBillStatsResponse{Groups: groups}
+	for _, group := range groups {
+		res.Count += group.Count
+	}
+	return res, nil
+}
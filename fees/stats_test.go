@@ -0,0 +1,40 @@
+package fees
+
+import (
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/mocks"
+)
+
+func (s *UnitTestSuite) Test_GetBillStats_GroupsByStatusAndCurrency() {
+	store := newFakeBillStore()
+	store.stats = []BillStats{
+		{Status: "closed", Currency: "USD", Count: 1, TotalAmount: 20.0},
+		{Status: "open", Currency: "GEL", Count: 1, TotalAmount: 100.0},
+		{Status: "open", Currency: "USD", Count: 2, TotalAmount: 25.5},
+	}
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  store,
+		eb:     *errs.B(),
+	}
+
+	resp, err := service.GetBillStats(tenantContext(testTenant), &GetBillStatsParams{MinTotal: 5, CustomerId: "acme"})
+	s.NoError(err)
+	s.Equal(4, resp.Count)
+	s.Equal(store.stats, resp.Groups)
+	s.Equal(billFilter{TenantId: testTenant.Id, CustomerId: "acme", MinTotal: 5}, store.filters[0])
+}
+
+func (s *UnitTestSuite) Test_GetBillStats_InvalidFilter() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	resp, err := service.GetBillStats(tenantContext(testTenant), &GetBillStatsParams{Status: "paid"})
+	s.EqualError(err, "invalid_argument: invalid status parameter, use open or closed")
+	s.Nil(resp)
+}
@@ -0,0 +1,451 @@
+package fees
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/storage/sqldb"
+)
+
+var db = sqldb.NewDatabase("fees", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+var errBillNotFound = errors.New("bill not found")
+
+// billRepository is the read model of bills, written by the ProjectBill activity
+type billRepository interface {
+	workflow.BillStore
+	workflow.BillLedger
+	GetBill(ctx context.Context, id string) (*workflow.Bill, error)
+	ListBills(ctx context.Context, query billQuery) ([]BillListItem, error)
+	AggregateBills(ctx context.Context, filter billFilter) ([]BillStats, error)
+	SearchLineItems(ctx context.Context, tenantId string, text string, limit int) ([]lineItemMatch, error)
+	ListEvents(ctx context.Context, billId string) ([]workflow.BillEvent, error)
+	// ListAuditEvents returns the events of the tenant's bills matching the query, in the order they happened
+	ListAuditEvents(ctx context.Context, query auditQuery) ([]workflow.BillEvent, error)
+}
+
+// billFilter narrows the bills listed, empty fields match every bill.
+// Ranges include their lower bound and exclude their upper bound.
+type billFilter struct {
+	TenantId      string // set from the request, bills of other tenants are never matched
+	Status        string // open or closed
+	Currency      string
+	CustomerId    string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	ClosedAfter   *time.Time
+	ClosedBefore  *time.Time
+	MinTotal      float64
+	MaxTotal      float64 // zero for no upper bound
+}
+
+const (
+	sortByCreatedAt   = "createdAt"
+	sortByTotalAmount = "totalAmount"
+)
+
+// billSort is the listing order, ties are broken by id
+type billSort struct {
+	Field      string `json:"field"` // createdAt, totalAmount
+	Descending bool   `json:"descending"`
+}
+
+// billQuery selects a page of bills
+type billQuery struct {
+	billFilter
+	Sort  billSort
+	Limit int
+	Expand bool // include the line items of each bill
+	After *billCursor // exclusive, the last bill of the previous page
+}
+
+// billCursor is the position of a bill in the listing order
+type billCursor struct {
+	Sort        billSort  `json:"sort"`
+	CreatedAt   time.Time `json:"createdAt"`
+	TotalAmount float64   `json:"totalAmount"`
+	Id          string    `json:"id"`
+}
+
+func nextBillCursor(last BillListItem, sort billSort) billCursor {
+	c := billCursor{Sort: sort, TotalAmount: last.TotalAmount, Id: last.Id}
+	if last.CreatedAt != nil {
+		c.CreatedAt = cursorTime(*last.CreatedAt)
+	}
+	return c
+}
+
+func (c billCursor) complete() bool {
+	return c.Id != ""
+}
+
+type billStore struct {
+	db *sqldb.Database
+}
+
+// SaveBill upserts the bill. A state older than the one saved is ignored, so a slow or retried
+// projection, or a rebuild racing the workflow, cannot take the bill back to an earlier version.
+func (s *billStore) SaveBill(ctx context.Context, bill workflow.Bill) error {
+	data, err := json.Marshal(bill)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bills (id, tenant_id, currency, customer_id, status, total_amount, line_item_count, data, created_at, closed_on, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			tenant_id = EXCLUDED.tenant_id,
+			currency = EXCLUDED.currency,
+			customer_id = EXCLUDED.customer_id,
+			status = EXCLUDED.status,
+			total_amount = EXCLUDED.total_amount,
+			line_item_count = EXCLUDED.line_item_count,
+			data = EXCLUDED.data,
+			created_at = EXCLUDED.created_at,
+			closed_on = EXCLUDED.closed_on,
+			updated_at = NOW()
+		WHERE COALESCE((bills.data->>'version')::INT, 0) <= COALESCE((EXCLUDED.data->>'version')::INT, 0)
+	`, bill.Id, billTenant(&bill), bill.Currency, bill.CustomerId, bill.Status(), bill.TotalAmount, bill.LineItemCount(), data, bill.CreatedAt, bill.ClosedOn)
+	if err != nil {
+		return err
+	}
+
+	// Line items are append only, items indexed by an earlier save are only updated when they are voided.
+	// A void is never undone, so an older state cannot clear it.
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bill_line_items (bill_id, position, id, description, amount, type, created_at, voided_at)
+		SELECT $1, item.position, COALESCE(item.value->>'id', ''), COALESCE(item.value->>'description', ''),
+			(item.value->>'amount')::DOUBLE PRECISION, COALESCE(item.value->>'type', ''), (item.value->>'createdAt')::TIMESTAMPTZ,
+			(item.value->>'voidedAt')::TIMESTAMPTZ
+		FROM jsonb_array_elements(
+			CASE jsonb_typeof($2::jsonb->'lineItems') WHEN 'array' THEN $2::jsonb->'lineItems' ELSE '[]'::jsonb END
+		) WITH ORDINALITY AS item (value, position)
+		ON CONFLICT (bill_id, position) DO UPDATE SET voided_at = EXCLUDED.voided_at
+		WHERE bill_line_items.voided_at IS NULL AND EXCLUDED.voided_at IS NOT NULL
+	`, bill.Id, data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *billStore) GetBill(ctx context.Context, id string) (*workflow.Bill, error) {
+	var data []byte
+	err := s.db.QueryRow(ctx, `SELECT data FROM bills WHERE id = $1`, id).Scan(&data)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errBillNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bill workflow.Bill
+	if err := json.Unmarshal(data, &bill); err != nil {
+		return nil, err
+	}
+	return &bill, nil
+}
+
+// AppendEvents records the events in one transaction, events already recorded by an earlier attempt are skipped
+func (s *billStore) AppendEvents(ctx context.Context, events []workflow.BillEvent) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		var actor *string
+		if event.Actor != nil && event.Actor.Principal != "" {
+			actor = &event.Actor.Principal
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO bill_events (bill_id, sequence, type, occurred_at, actor, data)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (bill_id, sequence) DO NOTHING
+		`, event.BillId, event.Sequence, event.Type, event.OccurredAt, actor, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListEvents returns the events of the bill in the order they happened
+func (s *billStore) ListEvents(ctx context.Context, billId string) ([]workflow.BillEvent, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT data FROM bill_events
+		WHERE bill_id = $1
+		ORDER BY sequence
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]workflow.BillEvent, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var event workflow.BillEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// ListBills returns a page of bills in the query's order, ties are broken by id so the order is stable.
+// Only the summary columns are read unless the query expands line items.
+func (s *billStore) ListBills(ctx context.Context, query billQuery) ([]BillListItem, error) {
+	where := filterConditions(query.billFilter)
+
+	column, direction, comparison := "created_at", "ASC", ">"
+	if query.Sort.Field == sortByTotalAmount {
+		column = "total_amount"
+	}
+	if query.Sort.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if query.After != nil {
+		var after interface{} = query.After.CreatedAt
+		if query.Sort.Field == sortByTotalAmount {
+			after = query.After.TotalAmount
+		}
+		where.add("("+column+", id) "+comparison+" (%s, %s)", after, query.After.Id)
+	}
+
+	lineItems := "NULL::jsonb"
+	if query.Expand {
+		lineItems = "data->'lineItems'"
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT id, currency, customer_id, status, total_amount, line_item_count, created_at, closed_on, `+lineItems+`
+		FROM bills
+		`+where.String()+`
+		ORDER BY `+column+` `+direction+`, id `+direction+`
+		LIMIT `+where.arg(query.Limit), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bills := make([]BillListItem, 0)
+	for rows.Next() {
+		var bill BillListItem
+		var items []byte
+		err := rows.Scan(&bill.Id, &bill.Currency, &bill.CustomerId, &bill.Status, &bill.TotalAmount,
+			&bill.LineItemCount, &bill.CreatedAt, &bill.ClosedOn, &items)
+		if err != nil {
+			return nil, err
+		}
+
+		if items != nil {
+			if err := json.Unmarshal(items, &bill.LineItems); err != nil {
+				return nil, err
+			}
+		}
+		bills = append(bills, bill)
+	}
+	return bills, rows.Err()
+}
+
+// AggregateBills counts and sums the totals of the matching bills by status and currency
+func (s *billStore) AggregateBills(ctx context.Context, filter billFilter) ([]BillStats, error) {
+	where := filterConditions(filter)
+
+	rows, err := s.db.Query(ctx, `
+		SELECT status, currency, COUNT(*), COALESCE(SUM(total_amount), 0)
+		FROM bills
+		`+where.String()+`
+		GROUP BY status, currency
+		ORDER BY status, currency
+	`, where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]BillStats, 0)
+	for rows.Next() {
+		var group BillStats
+		if err := rows.Scan(&group.Status, &group.Currency, &group.Count, &group.TotalAmount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, group)
+	}
+	return stats, rows.Err()
+}
+
+// lineItemMatch is a line item matching a search, with the matched words of its description highlighted.
+// The highlight is HTML, the description is escaped before the matched words are marked.
+type lineItemMatch struct {
+	BillId    string
+	Currency  string
+	Status    string
+	Item      workflow.LineItem
+	Highlight string
+}
+
+// escapedDescription escapes the line item description the same way as html.EscapeString,
+// so only the <mark> tags ts_headline adds are markup. The search parser reads the entities as separators.
+const escapedDescription = `replace(replace(replace(replace(replace(items.description,
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+
+// SearchLineItems finds the line items whose description matches the search text, best matches first.
+// Voided items are left out.
+func (s *billStore) SearchLineItems(ctx context.Context, tenantId string, text string, limit int) ([]lineItemMatch, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT items.bill_id, bills.currency, bills.status, items.id, items.description, items.amount, items.type, items.created_at,
+			ts_headline('english', `+escapedDescription+`, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')
+		FROM bill_line_items items
+		JOIN bills ON bills.id = items.bill_id,
+			websearch_to_tsquery('english', $1) query
+		WHERE items.search @@ query AND items.voided_at IS NULL AND bills.tenant_id = $3
+		ORDER BY ts_rank(items.search, query) DESC, bills.created_at DESC, items.bill_id, items.position
+		LIMIT $2
+	`, text, limit, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make([]lineItemMatch, 0)
+	for rows.Next() {
+		var m lineItemMatch
+		err := rows.Scan(&m.BillId, &m.Currency, &m.Status, &m.Item.Id, &m.Item.Description, &m.Item.Amount,
+			&m.Item.Type, &m.Item.CreatedAt, &m.Highlight)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// ListAuditEvents joins the events to the bills read model to scope them to the tenant
+func (s *billStore) ListAuditEvents(ctx context.Context, query auditQuery) ([]workflow.BillEvent, error) {
+	where := &sqlConditions{}
+	where.equals("bills.tenant_id", query.TenantId)
+	where.equals("bill_events.actor", query.Actor)
+	where.equals("bill_events.bill_id", query.BillId)
+	where.between("bill_events.occurred_at", query.From, query.To)
+	if query.After != nil {
+		where.add("(bill_events.occurred_at, bill_events.bill_id, bill_events.sequence) > (%s, %s, %s)",
+			query.After.OccurredAt, query.After.BillId, query.After.Sequence)
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT bill_events.data
+		FROM bill_events
+		JOIN bills ON bills.id = bill_events.bill_id
+		`+where.String()+`
+		ORDER BY bill_events.occurred_at, bill_events.bill_id, bill_events.sequence
+		LIMIT `+where.arg(query.Limit),
+		where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]workflow.BillEvent, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var event workflow.BillEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func filterConditions(filter billFilter) *sqlConditions {
+	where := &sqlConditions{}
+	where.equals("tenant_id", filter.TenantId)
+	where.equals("status", filter.Status)
+	where.equals("currency", filter.Currency)
+	where.equals("customer_id", filter.CustomerId)
+	where.between("created_at", filter.CreatedAfter, filter.CreatedBefore)
+	where.between("closed_on", filter.ClosedAfter, filter.ClosedBefore)
+	if filter.MinTotal > 0 {
+		where.add("total_amount >= %s", filter.MinTotal)
+	}
+	if filter.MaxTotal > 0 {
+		where.add("total_amount < %s", filter.MaxTotal)
+	}
+	return where
+}
+
+// sqlConditions builds a WHERE clause, values are always passed as query arguments and never formatted into the SQL
+type sqlConditions struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds a query argument and returns its placeholder
+func (c *sqlConditions) arg(value interface{}) string {
+	c.args = append(c.args, value)
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+// add appends a condition, each %s in the format is replaced with the placeholder of the matching value
+func (c *sqlConditions) add(format string, values ...interface{}) {
+	placeholders := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = c.arg(v)
+	}
+	c.conditions = append(c.conditions, fmt.Sprintf(format, placeholders...))
+}
+
+// equals adds an equality condition on the column unless the value is empty
+func (c *sqlConditions) equals(column string, value string) {
+	if value != "" {
+		c.add(column+" = %s", value)
+	}
+}
+
+// between adds a range condition on the column for the bounds that are set
+func (c *sqlConditions) between(column string, from, to *time.Time) {
+	if from != nil {
+		c.add(column+" >= %s", *from)
+	}
+	if to != nil {
+		c.add(column+" < %s", *to)
+	}
+}
+
+func (c *sqlConditions) String() string {
+	if len(c.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(c.conditions, " AND ")
+}
@@ -0,0 +1,322 @@
+package fees
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/fees/workflow"
+)
+
+// storeTenant returns the bill store on the test database, with a tenant of its own so tests
+// never see each other's bills. The database is only set up when the tests run with encore test.
+func (s *UnitTestSuite) storeTenant() (*billStore, string) {
+	if db == nil {
+		s.T().Skip("the test database is only available with encore test")
+	}
+	return &billStore{db: db}, fmt.Sprintf("store-%d", time.Now().UnixNano())
+}
+
+// storeBills saves the bills for the tenant, their ids are prefixed with the tenant
+func (s *UnitTestSuite) storeBills(store *billStore, tenantId string, bills ...workflow.Bill) {
+	for _, bill := range bills {
+		bill.Id = tenantId + "-" + bill.Id
+		bill.TenantId = tenantId
+		s.NoError(store.SaveBill(context.Background(), bill))
+	}
+}
+
+func billIds(tenantId string, bills []BillListItem) []string {
+	ids := make([]string, 0, len(bills))
+	for _, bill := range bills {
+		ids = append(ids, bill.Id[len(tenantId)+1:])
+	}
+	return ids
+}
+
+func (s *UnitTestSuite) Test_BillStore_SaveBill_KeepsNewerVersion() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	item := workflow.LineItem{Id: "a", Description: "Licence", Amount: 10.0, Type: workflow.LineItemFee}
+	newer := workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{item, item}, TotalAmount: 20.0, Version: 2}
+	older := workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{item}, TotalAmount: 10.0, Version: 1}
+	s.storeBills(store, tenantId, newer, older)
+
+	bill, err := store.GetBill(ctx, tenantId+"-1")
+	s.NoError(err)
+	s.Equal(2, bill.Version)
+	s.Equal(20.0, bill.TotalAmount)
+
+	bills, err := store.ListBills(ctx, billQuery{billFilter: billFilter{TenantId: tenantId}, Limit: 10})
+	s.NoError(err)
+	s.Len(bills, 1)
+	s.Equal(2, bills[0].LineItemCount)
+
+	_, err = store.GetBill(ctx, tenantId+"-2")
+	s.ErrorIs(err, errBillNotFound)
+}
+
+func (s *UnitTestSuite) Test_BillStore_ListBills_Filters() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	at := func(day int) *time.Time {
+		t := time.Date(2024, 9, day, 12, 0, 0, 0, time.UTC)
+		return &t
+	}
+	s.storeBills(store, tenantId,
+		workflow.Bill{Id: "1", Currency: "USD", CustomerId: "acme", TotalAmount: 10.0, CreatedAt: at(1)},
+		workflow.Bill{Id: "2", Currency: "GEL", CustomerId: "acme", TotalAmount: 25.0, CreatedAt: at(2), ClosedOn: at(10)},
+		workflow.Bill{Id: "3", Currency: "USD", CustomerId: "globex", TotalAmount: 50.0, CreatedAt: at(3), ClosedOn: at(20)},
+	)
+	// Bills of other tenants are never listed
+	s.storeBills(store, tenantId+"-other", workflow.Bill{Id: "1", Currency: "USD", CustomerId: "acme", CreatedAt: at(1)})
+
+	tests := []struct {
+		filter billFilter
+		ids    []string
+	}{
+		{billFilter{}, []string{"1", "2", "3"}},
+		{billFilter{Status: workflow.StatusOpen}, []string{"1"}},
+		{billFilter{Status: workflow.StatusClosed}, []string{"2", "3"}},
+		{billFilter{Currency: "USD"}, []string{"1", "3"}},
+		{billFilter{CustomerId: "acme"}, []string{"1", "2"}},
+		{billFilter{CreatedAfter: at(2)}, []string{"2", "3"}},
+		{billFilter{CreatedBefore: at(2)}, []string{"1"}},
+		{billFilter{ClosedAfter: at(10), ClosedBefore: at(20)}, []string{"2"}},
+		{billFilter{MinTotal: 25.0}, []string{"2", "3"}},
+		{billFilter{MaxTotal: 25.0}, []string{"1"}},
+		{billFilter{Currency: "USD", MinTotal: 20.0, Status: workflow.StatusClosed}, []string{"3"}},
+	}
+	for _, test := range tests {
+		test.filter.TenantId = tenantId
+		bills, err := store.ListBills(ctx, billQuery{billFilter: test.filter, Limit: 10})
+		s.NoError(err)
+		s.Equal(test.ids, billIds(tenantId, bills), test.filter)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillStore_ListBills_RangesAndSort() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	// Bills 2 and 3 tie on both sort columns, the id breaks the tie.
+	// The creation times have nanoseconds, which the database drops.
+	created := time.Date(2024, 9, 2, 9, 30, 0, 123456789, time.UTC)
+	later := created.Add(time.Hour)
+	s.storeBills(store, tenantId,
+		workflow.Bill{Id: "1", Currency: "USD", TotalAmount: 30.0, CreatedAt: &later},
+		workflow.Bill{Id: "3", Currency: "USD", TotalAmount: 10.0, CreatedAt: &created},
+		workflow.Bill{Id: "2", Currency: "USD", TotalAmount: 10.0, CreatedAt: &created},
+		workflow.Bill{Id: "4", Currency: "USD", TotalAmount: 20.0, CreatedAt: &later},
+	)
+
+	tests := []struct {
+		sort billSort
+		ids  []string
+	}{
+		{billSort{Field: sortByCreatedAt}, []string{"2", "3", "1", "4"}},
+		{billSort{Field: sortByCreatedAt, Descending: true}, []string{"4", "1", "3", "2"}},
+		{billSort{Field: sortByTotalAmount}, []string{"2", "3", "4", "1"}},
+		{billSort{Field: sortByTotalAmount, Descending: true}, []string{"1", "4", "3", "2"}},
+	}
+	for _, test := range tests {
+		query := billQuery{billFilter: billFilter{TenantId: tenantId}, Sort: test.sort, Limit: 10}
+		bills, err := store.ListBills(ctx, query)
+		s.NoError(err)
+		s.Equal(test.ids, billIds(tenantId, bills), test.sort)
+
+		// Pages of one bill, each after the cursor of the previous one, list the bills in the same order
+		query.Limit = 1
+		paged := make([]BillListItem, 0)
+		for {
+			page, err := store.ListBills(ctx, query)
+			s.NoError(err)
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, page...)
+			cursor := nextBillCursor(page[0], test.sort)
+			query.After = &cursor
+		}
+		s.Equal(test.ids, billIds(tenantId, paged), test.sort)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillStore_ListBills_Expand() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	item := workflow.LineItem{Id: "a", Description: "Licence", Amount: 10.0, Type: workflow.LineItemFee}
+	s.storeBills(store, tenantId, workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{item}, TotalAmount: 10.0})
+
+	query := billQuery{billFilter: billFilter{TenantId: tenantId}, Limit: 10}
+	bills, err := store.ListBills(ctx, query)
+	s.NoError(err)
+	s.Equal(1, bills[0].LineItemCount)
+	s.Nil(bills[0].LineItems)
+
+	query.Expand = true
+	bills, err = store.ListBills(ctx, query)
+	s.NoError(err)
+	s.Equal([]workflow.LineItem{item}, bills[0].LineItems)
+}
+
+func (s *UnitTestSuite) Test_BillStore_AggregateBills() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	closed := time.Date(2024, 9, 10, 0, 0, 0, 0, time.UTC)
+	s.storeBills(store, tenantId,
+		workflow.Bill{Id: "1", Currency: "USD", TotalAmount: 10.0},
+		workflow.Bill{Id: "2", Currency: "USD", TotalAmount: 15.5},
+		workflow.Bill{Id: "3", Currency: "GEL", TotalAmount: 100.0},
+		workflow.Bill{Id: "4", Currency: "USD", TotalAmount: 20.0, ClosedOn: &closed},
+		workflow.Bill{Id: "5", Currency: "USD", TotalAmount: 1.0},
+	)
+
+	stats, err := store.AggregateBills(ctx, billFilter{TenantId: tenantId, MinTotal: 5.0})
+	s.NoError(err)
+	s.Equal([]BillStats{
+		{Status: workflow.StatusClosed, Currency: "USD", Count: 1, TotalAmount: 20.0},
+		{Status: workflow.StatusOpen, Currency: "GEL", Count: 1, TotalAmount: 100.0},
+		{Status: workflow.StatusOpen, Currency: "USD", Count: 2, TotalAmount: 25.5},
+	}, stats)
+
+	stats, err = store.AggregateBills(ctx, billFilter{TenantId: tenantId, Currency: "EUR"})
+	s.NoError(err)
+	s.Empty(stats)
+}
+
+func (s *UnitTestSuite) Test_BillStore_SearchLineItems() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	item := func(id, description string) workflow.LineItem {
+		return workflow.LineItem{Id: id, Description: description, Amount: 10.0, Type: workflow.LineItemFee}
+	}
+	s.storeBills(store, tenantId,
+		workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{
+			item("a", "Annual licence"),
+			item("b", "Support"),
+			item("c", `<img src=x onerror="alert(1)"> licence`),
+		}},
+		workflow.Bill{Id: "2", Currency: "GEL", LineItems: []workflow.LineItem{item("d", "Licence, licence and more licences")}},
+	)
+	s.storeBills(store, tenantId+"-other", workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{item("a", "Licence")}})
+
+	matches, err := store.SearchLineItems(ctx, tenantId, "licence", 10)
+	s.NoError(err)
+	s.Len(matches, 3)
+
+	// The item mentioning the word most ranks first
+	s.Equal(tenantId+"-2", matches[0].BillId)
+	s.Equal("GEL", matches[0].Currency)
+	s.Equal("<mark>Licence</mark>, <mark>licence</mark> and more <mark>licences</mark>", matches[0].Highlight)
+
+	// Only the marks are markup, the description is escaped
+	for _, m := range matches[1:] {
+		s.Equal(tenantId+"-1", m.BillId)
+		if m.Item.Id == "c" {
+			s.Equal(`&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <mark>licence</mark>`, m.Highlight)
+			s.Equal(`<img src=x onerror="alert(1)"> licence`, m.Item.Description)
+		} else {
+			s.Equal("a", m.Item.Id)
+			s.Equal("Annual <mark>licence</mark>", m.Highlight)
+		}
+	}
+
+	matches, err = store.SearchLineItems(ctx, tenantId, "licence", 1)
+	s.NoError(err)
+	s.Len(matches, 1)
+
+	matches, err = store.SearchLineItems(ctx, tenantId, "invoice", 10)
+	s.NoError(err)
+	s.Empty(matches)
+}
+
+func (s *UnitTestSuite) Test_BillStore_SearchLineItems_SkipsVoided() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	bill := workflow.Bill{Id: "1", Currency: "USD", LineItems: []workflow.LineItem{
+		{Id: "a", Description: "Annual licence", Amount: 10.0, Type: workflow.LineItemFee},
+		{Id: "b", Description: "Support licence", Amount: 5.0, Type: workflow.LineItemFee},
+	}, TotalAmount: 15.0, Version: 2}
+	s.storeBills(store, tenantId, bill)
+
+	older := bill
+	older.LineItems = append([]workflow.LineItem{}, bill.LineItems...)
+	_, ok := bill.VoidLineItem("a", "charged twice", time.Now())
+	s.True(ok)
+	s.storeBills(store, tenantId, bill)
+
+	matches, err := store.SearchLineItems(ctx, tenantId, "licence", 10)
+	s.NoError(err)
+	s.Len(matches, 1)
+	s.Equal("b", matches[0].Item.Id)
+
+	// Saving an older state does not bring the voided item back
+	s.storeBills(store, tenantId, older)
+	matches, err = store.SearchLineItems(ctx, tenantId, "licence", 10)
+	s.NoError(err)
+	s.Len(matches, 1)
+	s.Equal("b", matches[0].Item.Id)
+}
+
+func (s *UnitTestSuite) Test_BillStore_ListAuditEvents() {
+	store, tenantId := s.storeTenant()
+	ctx := context.Background()
+
+	s.storeBills(store, tenantId, workflow.Bill{Id: "1", Currency: "USD"}, workflow.Bill{Id: "2", Currency: "USD"})
+	s.storeBills(store, tenantId+"-other", workflow.Bill{Id: "1", Currency: "USD"})
+
+	// Events 1/1 and 2/0 happen at the same time, the bill id breaks the tie
+	at := time.Date(2024, 9, 1, 9, 0, 0, 123456789, time.UTC)
+	biller := &workflow.Actor{Principal: "biller"}
+	approver := &workflow.Actor{Principal: "approver"}
+	s.NoError(store.AppendEvents(ctx, []workflow.BillEvent{
+		{BillId: tenantId + "-1", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at, Actor: biller},
+		{BillId: tenantId + "-1", Sequence: 1, Type: workflow.EventItemAdded, OccurredAt: at.Add(time.Hour), Actor: biller},
+		{BillId: tenantId + "-1", Sequence: 2, Type: workflow.EventClosed, OccurredAt: at.Add(2 * time.Hour), Actor: approver},
+		{BillId: tenantId + "-2", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at.Add(time.Hour), Actor: biller},
+		{BillId: tenantId + "-other-1", Sequence: 0, Type: workflow.EventCreated, OccurredAt: at, Actor: biller},
+	}))
+
+	position := func(events []workflow.BillEvent) []string {
+		res := make([]string, 0, len(events))
+		for _, e := range events {
+			res = append(res, fmt.Sprintf("%s/%d", e.BillId[len(tenantId)+1:], e.Sequence))
+		}
+		return res
+	}
+
+	events, err := store.ListAuditEvents(ctx, auditQuery{TenantId: tenantId, Limit: 10})
+	s.NoError(err)
+	s.Equal([]string{"1/0", "1/1", "2/0", "1/2"}, position(events))
+
+	from, to := at.Add(30*time.Minute), at.Add(2*time.Hour)
+	events, err = store.ListAuditEvents(ctx, auditQuery{TenantId: tenantId, Actor: "biller", From: &from, To: &to, Limit: 10})
+	s.NoError(err)
+	s.Equal([]string{"1/1", "2/0"}, position(events))
+
+	events, err = store.ListAuditEvents(ctx, auditQuery{TenantId: tenantId, BillId: tenantId + "-2", Limit: 10})
+	s.NoError(err)
+	s.Equal([]string{"2/0"}, position(events))
+
+	// Pages of one event, each after the cursor of the previous one
+	query := auditQuery{TenantId: tenantId, Limit: 1}
+	paged := make([]workflow.BillEvent, 0)
+	for {
+		page, err := store.ListAuditEvents(ctx, query)
+		s.NoError(err)
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		cursor := nextAuditCursor(page[0])
+		query.After = &cursor
+	}
+	s.Equal([]string{"1/0", "1/1", "2/0", "1/2"}, position(paged))
+}
@@ -0,0 +1,391 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+	"go.temporal.io/api/common/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
+)
+
+// Subscriptions are Temporal schedules that start a new bill workflow every period.
+const subscriptionMemoKey = "subscription"
+
+var subscriptionPeriods = map[string]string{
+	"daily":   "@daily",
+	"weekly":  "@weekly",
+	"monthly": "@monthly",
+}
+
+type LineItemTemplate struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+type CreateSubscriptionRequest struct {
+	CustomerId string             `json:"customerId"`
+	Currency   string             `json:"currency"` // defaults to the customer's default currency, which it must match
+	Period     string             `json:"period"`   // daily, weekly, monthly
+	StartAt    *time.Time         `json:"startAt"`  // defaults to now
+	LineItems  []LineItemTemplate `json:"lineItems"`
+}
+
+type CreateSubscriptionResponse struct {
+	Id string `json:"id"`
+}
+
+type SubscriptionRequest struct {
+	Id string `json:"id"`
+}
+
+type Subscription struct {
+	Id           string             `json:"id"`
+	TenantId     string             `json:"tenantId"`
+	CustomerId   string             `json:"customerId"` // empty for subscriptions created before bills had customers
+	Currency     string             `json:"currency"`
+	Period       string             `json:"period"`
+	LineItems    []LineItemTemplate `json:"lineItems"`
+	Paused       bool               `json:"paused"`
+	UpcomingRuns []time.Time        `json:"upcomingRuns"`
+}
+
+type GetSubscriptionsResponse struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+type GetSubscriptionBillsParams struct {
+	PageSize int    `query:"pageSize"` // defaults to 50, at most 200
+	Cursor   string `query:"cursor"`   // nextCursor of the previous page
+}
+
+// SubscriptionBill is a bill started by the subscription, summarised from its workflow memo
+type SubscriptionBill struct {
+	Id        string               `json:"id"`
+	StartedAt *time.Time           `json:"startedAt"`
+	Summary   workflow.BillSummary `json:"summary"`
+}
+
+type GetSubscriptionBillsResponse struct {
+	Bills      []SubscriptionBill `json:"bills"`      // latest first
+	Failed     []FailedBill       `json:"failed"`     // bills without a summary that could not be read
+	NextCursor string             `json:"nextCursor"` // empty on the last page
+}
+
+// encore:api auth method=POST path=/api/subscription
+func (s *Service) CreateSubscription(ctx context.Context, req *CreateSubscriptionRequest) (*CreateSubscriptionResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CustomerId == "" {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("customer id is required").Err()
+	}
+	customer, err := s.customers.GetCustomer(ctx, tenant.Id, req.CustomerId)
+	if errors.Is(err, errCustomerNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("customer not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading customer", "id", req.CustomerId, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create subscription").Err()
+	}
+
+	// Every bill of the subscription is raised in the customer's currency
+	currency := req.Currency
+	if currency == "" {
+		currency = customer.DefaultCurrency
+	}
+	if currency != customer.DefaultCurrency {
+		return nil, s.eb.Code(errs.InvalidArgument).Msgf("currency must be the customer's default currency, %s", customer.DefaultCurrency).Err()
+	}
+	if !tenant.allows(currency) {
+		return nil, s.unsupportedCurrency(tenant)
+	}
+
+	cron, ok := subscriptionPeriods[req.Period]
+	if !ok {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("invalid period, use daily, weekly or monthly").Err()
+	}
+
+	// Every period starts a bill pre-filled with the template line items, they are part of the bill as created at version 0
+	bill := workflow.Bill{
+		Currency:   currency,
+		CustomerId: customer.Id,
+		TenantId:   tenant.Id,
+		LineItems:  make([]workflow.LineItem, 0),
+	}
+	for i, item := range req.LineItems {
+		if item.Amount <= 0 {
+			return nil, s.eb.Code(errs.InvalidArgument).Msg("amount must be greater than 0").Err()
+		}
+		bill.LineItems = append(bill.LineItems, workflow.LineItem{
+			Id:          fmt.Sprintf("template-%d", i+1),
+			Description: item.Description,
+			Amount:      item.Amount,
+			Type:        workflow.LineItemFee,
+		})
+		bill.TotalAmount += item.Amount
+	}
+
+	id := uuid.New().String()
+	bill.SubscriptionId = id
+
+	spec := client.ScheduleSpec{CronExpressions: []string{cron}}
+	if req.StartAt != nil {
+		spec.StartAt = *req.StartAt
+	}
+
+	rlog.Info("Creating subscription", "id", id, "customer", customer.Id, "period", req.Period)
+
+	// The schedule indexes its tenant like bills do, so subscriptions are listed per tenant
+	_, err = s.client.ScheduleClient().Create(ctx, client.ScheduleOptions{
+		ID:                    id,
+		Spec:                  spec,
+		TypedSearchAttributes: temporal.NewSearchAttributes(workflow.TenantIdKey.ValueSet(tenant.Id)),
+		Action: &client.ScheduleWorkflowAction{
+			ID:        "bill-" + id,
+			Workflow:  workflow.BillWorkflow,
+			Args:      []interface{}{bill},
+			TaskQueue: billTaskQueue,
+		},
+		Memo: map[string]interface{}{
+			subscriptionMemoKey: Subscription{
+				Id:         id,
+				TenantId:   tenant.Id,
+				CustomerId: customer.Id,
+				Currency:   currency,
+				Period:     req.Period,
+				LineItems:  req.LineItems,
+			},
+		},
+	})
+	if err != nil {
+		rlog.Error("Error creating schedule", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create subscription").Err()
+	}
+
+	return &CreateSubscriptionResponse{Id: id}, nil
+}
+
+// encore:api auth method=POST path=/api/subscription/pause
+func (s *Service) PauseSubscription(ctx context.Context, req *SubscriptionRequest) error {
+	rlog.Info("Pausing subscription", "id", req.Id)
+
+	if _, err := s.GetSubscription(ctx, req.Id); err != nil {
+		return err
+	}
+
+	err := s.client.ScheduleClient().GetHandle(ctx, req.Id).Pause(ctx, client.SchedulePauseOptions{})
+	if err != nil {
+		return s.eb.Code(errs.Internal).Msg("unable to pause subscription").Err()
+	}
+	return nil
+}
+
+// encore:api auth method=POST path=/api/subscription/resume
+func (s *Service) ResumeSubscription(ctx context.Context, req *SubscriptionRequest) error {
+	rlog.Info("Resuming subscription", "id", req.Id)
+
+	if _, err := s.GetSubscription(ctx, req.Id); err != nil {
+		return err
+	}
+
+	err := s.client.ScheduleClient().GetHandle(ctx, req.Id).Unpause(ctx, client.ScheduleUnpauseOptions{})
+	if err != nil {
+		return s.eb.Code(errs.Internal).Msg("unable to resume subscription").Err()
+	}
+	return nil
+}
+
+// encore:api auth method=POST path=/api/subscription/cancel
+func (s *Service) CancelSubscription(ctx context.Context, req *SubscriptionRequest) error {
+	rlog.Info("Cancelling subscription", "id", req.Id)
+
+	if _, err := s.GetSubscription(ctx, req.Id); err != nil {
+		return err
+	}
+
+	// Bills already started by the schedule are left open
+	err := s.client.ScheduleClient().GetHandle(ctx, req.Id).Delete(ctx)
+	if err != nil {
+		return s.eb.Code(errs.Internal).Msg("unable to cancel subscription").Err()
+	}
+	return nil
+}
+
+// encore:api auth method=GET path=/api/subscription/:id
+func (s *Service) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := s.client.ScheduleClient().GetHandle(ctx, id).Describe(ctx)
+	if isNotFound(err) {
+		return nil, s.eb.Code(errs.NotFound).Msg("subscription not found").Err()
+	}
+	if err != nil {
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get subscription").Err()
+	}
+
+	sub, err := subscriptionFromMemo(desc.Memo)
+	if err != nil {
+		rlog.Error("Error decoding subscription memo", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get subscription").Err()
+	}
+	if sub.tenant() != tenant.Id {
+		rlog.Warn("Subscription requested by another tenant", "id", id, "tenant", tenant.Id)
+		return nil, s.eb.Code(errs.NotFound).Msg("subscription not found").Err()
+	}
+
+	sub.Id = id
+	sub.Paused = desc.Schedule.State != nil && desc.Schedule.State.Paused
+	sub.UpcomingRuns = desc.Info.NextActionTimes
+
+	return &sub, nil
+}
+
+// encore:api auth method=GET path=/api/subscriptions
+func (s *Service) GetSubscriptions(ctx context.Context) (*GetSubscriptionsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &visibilityQuery{}
+	q.tenant(tenant.Id)
+	iter, err := s.client.ScheduleClient().List(ctx, client.ScheduleListOptions{Query: q.String()})
+	if err != nil {
+		rlog.Error("Error listing schedules", "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get subscriptions").Err()
+	}
+
+	subs := make([]Subscription, 0)
+	for iter.HasNext() {
+		entry, err := iter.Next()
+		if err != nil {
+			rlog.Error("Error listing schedules", "error", err)
+			return nil, s.eb.Code(errs.Internal).Msg("unable to get subscriptions").Err()
+		}
+
+		// Skip schedules that were not created as subscriptions. The query already matches the tenant,
+		// this guards schedules whose memo names another one.
+		sub, err := subscriptionFromMemo(entry.Memo)
+		if err != nil || sub.tenant() != tenant.Id {
+			continue
+		}
+
+		sub.Id = entry.ID
+		sub.Paused = entry.Paused
+		sub.UpcomingRuns = entry.NextActionTimes
+		subs = append(subs, sub)
+	}
+
+	return &GetSubscriptionsResponse{Subscriptions: subs}, nil
+}
+
+// GetSubscriptionBills lists the bills the subscription started, with the summary each bill keeps in its memo.
+// The summaries come from one workflow listing, bills started before the memo existed are read one by one.
+// encore:api auth method=GET path=/api/subscription/:id/bills
+func (s *Service) GetSubscriptionBills(ctx context.Context, id string, params *GetSubscriptionBillsParams) (*GetSubscriptionBillsResponse, error) {
+	if _, err := s.GetSubscription(ctx, id); err != nil {
+		return nil, err
+	}
+
+	// Temporal pages the listing itself, the cursor is its page token
+	var cursor workflowPageToken
+	pageSize, _, err := s.parsePage(params.PageSize, params.Cursor, &cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Temporal records the schedule that started each bill, runs that continued as new are superseded
+	q := &visibilityQuery{}
+	q.equals("WorkflowType", "BillWorkflow")
+	q.equals("TemporalScheduledById", id)
+	q.add("ExecutionStatus != %s", "ContinuedAsNew")
+
+	page, err := s.client.ListWorkflow(ctx, &workflowservice.ListWorkflowExecutionsRequest{
+		Query:         q.String(),
+		PageSize:      int32(pageSize),
+		NextPageToken: cursor.Token,
+	})
+	if err != nil {
+		rlog.Error("Error listing subscription bills", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get subscription bills").Err()
+	}
+
+	res := &GetSubscriptionBillsResponse{Bills: make([]SubscriptionBill, 0, len(page.Executions)), Failed: make([]FailedBill, 0)}
+	for _, e := range page.Executions {
+		bill := SubscriptionBill{Id: e.GetExecution().GetWorkflowId()}
+		if e.StartTime != nil {
+			startedAt := e.StartTime.AsTime()
+			bill.StartedAt = &startedAt
+		}
+
+		// Bills started before the summary memo are read one at a time, one that cannot be read does not fail the page
+		summary, err := summaryFromMemo(e.GetMemo())
+		if err != nil {
+			full, err := s.getBill(ctx, bill.Id)
+			if err != nil {
+				rlog.Warn("Skipping subscription bill", "id", id, "billId", bill.Id, "error", err)
+				res.Failed = append(res.Failed, FailedBill{Id: bill.Id, Error: err.Error()})
+				continue
+			}
+			summary = full.Summary()
+		}
+		bill.Summary = summary
+		res.Bills = append(res.Bills, bill)
+	}
+	if len(page.NextPageToken) > 0 {
+		res.NextCursor = encodeCursor(workflowPageToken{Token: page.NextPageToken})
+	}
+
+	return res, nil
+}
+
+// tenant is the tenant owning the subscription
+func (sub *Subscription) tenant() string {
+	if sub.TenantId == "" {
+		return defaultTenantId
+	}
+	return sub.TenantId
+}
+
+func subscriptionFromMemo(memo *common.Memo) (Subscription, error) {
+	var sub Subscription
+	payload, ok := memo.GetFields()[subscriptionMemoKey]
+	if !ok {
+		return sub, errors.New("schedule is not a subscription")
+	}
+	err := converter.GetDefaultDataConverter().FromPayload(payload, &sub)
+	return sub, err
+}
+
+// workflowPageToken is the position in a workflow listing, as Temporal reports it
+type workflowPageToken struct {
+	Token []byte `json:"token"`
+}
+
+func (c workflowPageToken) complete() bool {
+	return len(c.Token) > 0
+}
+
+func summaryFromMemo(memo *common.Memo) (workflow.BillSummary, error) {
+	var summary workflow.BillSummary
+	payload, ok := memo.GetFields()[workflow.SummaryMemoKey]
+	if !ok {
+		return summary, errors.New("bill has no summary memo")
+	}
+	err := converter.GetDefaultDataConverter().FromPayload(payload, &summary)
+	return summary, err
+}
@@ -0,0 +1,295 @@
+package fees
+
+import (
+	"errors"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/common/v1"
+	temporalworkflow "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/mocks"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func mockSubscriptionMemo(sub Subscription) *common.Memo {
+	payload, _ := converter.GetDefaultDataConverter().ToPayload(sub)
+	return &common.Memo{Fields: map[string]*common.Payload{subscriptionMemoKey: payload}}
+}
+
+func (s *UnitTestSuite) Test_CreateSubscription_Success() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer),
+		eb:        *errs.B(),
+	}
+
+	var options client.ScheduleOptions
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("Create", mock.Anything, mock.MatchedBy(func(o client.ScheduleOptions) bool {
+		return len(o.Spec.CronExpressions) == 1 && o.Spec.CronExpressions[0] == "@monthly"
+	})).Run(func(args mock.Arguments) {
+		options = args.Get(1).(client.ScheduleOptions)
+	}).Return(mocks.NewScheduleHandle(s.T()), nil)
+
+	req := &CreateSubscriptionRequest{
+		CustomerId: testCustomer.Id,
+		Period:     "monthly",
+		LineItems: []LineItemTemplate{
+			{Description: "plan", Amount: 10.0},
+		},
+	}
+
+	resp, err := service.CreateSubscription(tenantContext(testTenant), req)
+	s.NoError(err)
+	s.NotEmpty(resp.Id)
+
+	// Every bill is raised against the customer, in its default currency
+	bill := options.Action.(*client.ScheduleWorkflowAction).Args[0].(workflow.Bill)
+	s.Equal(testCustomer.Id, bill.CustomerId)
+	s.Equal("GEL", bill.Currency)
+	s.Equal(10.0, bill.TotalAmount)
+
+	// The template items are part of the bill as created
+	s.Len(bill.LineItems, 1)
+	s.Equal(0, bill.Version)
+
+	sub := options.Memo[subscriptionMemoKey].(Subscription)
+	s.Equal(testCustomer.Id, sub.CustomerId)
+	s.Equal("GEL", sub.Currency)
+
+	// The schedule indexes its tenant so subscriptions are listed per tenant
+	tenantId, ok := options.TypedSearchAttributes.GetKeyword(workflow.TenantIdKey)
+	s.True(ok)
+	s.Equal(testTenant.Id, tenantId)
+}
+
+func (s *UnitTestSuite) Test_CreateSubscription_Invalid() {
+	service := &Service{
+		client:    mocks.NewClient(s.T()),
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer, Customer{Id: "other-customer", Name: "Globex", DefaultCurrency: "USD", TenantId: otherTenant.Id}),
+		eb:        *errs.B(),
+	}
+
+	tests := []struct {
+		req *CreateSubscriptionRequest
+		err string
+	}{
+		{&CreateSubscriptionRequest{Period: "monthly"}, "invalid_argument: customer id is required"},
+		{&CreateSubscriptionRequest{CustomerId: "unknown", Period: "monthly"}, "not_found: customer not found"},
+		// Customers of other tenants are not found
+		{&CreateSubscriptionRequest{CustomerId: "other-customer", Period: "monthly"}, "not_found: customer not found"},
+		{&CreateSubscriptionRequest{CustomerId: testCustomer.Id, Currency: "USD", Period: "monthly"}, "invalid_argument: currency must be the customer's default currency, GEL"},
+		{&CreateSubscriptionRequest{CustomerId: testCustomer.Id, Period: "hourly"}, "invalid_argument: invalid period, use daily, weekly or monthly"},
+	}
+	for _, test := range tests {
+		resp, err := service.CreateSubscription(tenantContext(testTenant), test.req)
+		s.EqualError(err, test.err, test.req)
+		s.Nil(resp)
+	}
+}
+
+func (s *UnitTestSuite) Test_PauseSubscription_Fail() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		eb:     *errs.B(),
+	}
+
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, "1234").Return(mockHandle)
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{Currency: "USD", Period: "monthly"}),
+	}, nil)
+	mockHandle.On("Pause", mock.Anything, mock.Anything).Return(errors.New("error"))
+
+	err := service.PauseSubscription(tenantContext(testTenant), &SubscriptionRequest{Id: "1234"})
+	s.EqualError(err, "internal: unable to pause subscription")
+}
+
+func (s *UnitTestSuite) Test_GetSubscription_Success() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		eb:     *errs.B(),
+	}
+
+	next := time.Now().AddDate(0, 1, 0)
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, "1234").Return(mockHandle)
+	desc := &client.ScheduleDescription{
+		Schedule: client.Schedule{State: &client.ScheduleState{Paused: true}},
+		Memo:     mockSubscriptionMemo(Subscription{Currency: "GEL", Period: "weekly"}),
+	}
+	desc.Info.NextActionTimes = []time.Time{next}
+	mockHandle.On("Describe", mock.Anything).Return(desc, nil)
+
+	sub, err := service.GetSubscription(tenantContext(testTenant), "1234")
+	s.NoError(err)
+	s.Equal("1234", sub.Id)
+	s.Equal("GEL", sub.Currency)
+	s.True(sub.Paused)
+	s.Equal([]time.Time{next}, sub.UpcomingRuns)
+}
+
+func (s *UnitTestSuite) Test_GetSubscriptions_SkipsOtherSchedules() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockIter := mocks.NewScheduleListIterator(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		eb:     *errs.B(),
+	}
+
+	// Only the schedules of the tenant are listed
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("List", mock.Anything, client.ScheduleListOptions{
+		Query: "(BillTenantId = 'default' OR BillTenantId IS NULL)",
+	}).Return(mockIter, nil)
+	mockIter.On("HasNext").Return(true).Twice()
+	mockIter.On("HasNext").Return(false).Once()
+	mockIter.On("Next").Return(&client.ScheduleListEntry{
+		ID:   "1234",
+		Memo: mockSubscriptionMemo(Subscription{Currency: "USD", Period: "monthly"}),
+	}, nil).Once()
+	mockIter.On("Next").Return(&client.ScheduleListEntry{ID: "other"}, nil).Once()
+
+	resp, err := service.GetSubscriptions(tenantContext(testTenant))
+	s.NoError(err)
+	s.Len(resp.Subscriptions, 1)
+	s.Equal("1234", resp.Subscriptions[0].Id)
+}
+
+func mockSummaryMemo(summary workflow.BillSummary) *common.Memo {
+	payload, _ := converter.GetDefaultDataConverter().ToPayload(summary)
+	return &common.Memo{Fields: map[string]*common.Payload{workflow.SummaryMemoKey: payload}}
+}
+
+func (s *UnitTestSuite) Test_GetSubscriptionBills() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	// The older bill was started before bills kept a summary memo
+	older := workflow.Bill{Id: "bill-1234-2024-08-01T00:00:00Z", Currency: "USD", TotalAmount: 5.0, LineItems: []workflow.LineItem{{Id: "a", Amount: 5.0}}}
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(older),
+		cache:  newBillCache(),
+		eb:     *errs.B(),
+	}
+
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, "1234").Return(mockHandle)
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{Currency: "USD", Period: "monthly"}),
+	}, nil)
+
+	started := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	summary := workflow.BillSummary{Currency: "USD", TotalAmount: 12.5, LineItemCount: 2, Status: workflow.StatusOpen}
+	mockClient.On("ListWorkflow", mock.Anything, mock.MatchedBy(func(req *workflowservice.ListWorkflowExecutionsRequest) bool {
+		return req.Query == "WorkflowType = 'BillWorkflow' AND TemporalScheduledById = '1234' AND ExecutionStatus != 'ContinuedAsNew'" &&
+			req.PageSize == 2 && string(req.NextPageToken) == "page1"
+	})).Return(&workflowservice.ListWorkflowExecutionsResponse{
+		Executions: []*temporalworkflow.WorkflowExecutionInfo{
+			{
+				Execution: &common.WorkflowExecution{WorkflowId: "bill-1234-2024-09-01T00:00:00Z"},
+				StartTime: timestamppb.New(started),
+				Memo:      mockSummaryMemo(summary),
+			},
+			{Execution: &common.WorkflowExecution{WorkflowId: older.Id}},
+		},
+		NextPageToken: []byte("page2"),
+	}, nil)
+
+	cursor := encodeCursor(workflowPageToken{Token: []byte("page1")})
+	resp, err := service.GetSubscriptionBills(tenantContext(testTenant), "1234", &GetSubscriptionBillsParams{PageSize: 2, Cursor: cursor})
+	s.NoError(err)
+	s.Len(resp.Bills, 2)
+	s.Equal(SubscriptionBill{Id: "bill-1234-2024-09-01T00:00:00Z", StartedAt: &started, Summary: summary}, resp.Bills[0])
+	s.Equal(workflow.BillSummary{Currency: "USD", TotalAmount: 5.0, LineItemCount: 1, Status: workflow.StatusOpen}, resp.Bills[1].Summary)
+	s.Equal(encodeCursor(workflowPageToken{Token: []byte("page2")}), resp.NextCursor)
+}
+
+func (s *UnitTestSuite) Test_GetSubscriptionBills_ReportsUnreadableBills() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		store:  newFakeBillStore(),
+		cache:  newBillCache(),
+		eb:     *errs.B(),
+	}
+
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, "1234").Return(mockHandle)
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{Currency: "USD", Period: "monthly"}),
+	}, nil)
+
+	// The older bill has no summary memo and its workflow cannot be queried
+	summary := workflow.BillSummary{Currency: "USD", TotalAmount: 12.5, LineItemCount: 2, Status: workflow.StatusOpen}
+	mockClient.On("ListWorkflow", mock.Anything, mock.Anything).Return(&workflowservice.ListWorkflowExecutionsResponse{
+		Executions: []*temporalworkflow.WorkflowExecutionInfo{
+			{Execution: &common.WorkflowExecution{WorkflowId: "bill-1234-2024-09-01T00:00:00Z"}, Memo: mockSummaryMemo(summary)},
+			{Execution: &common.WorkflowExecution{WorkflowId: "bill-1234-2024-08-01T00:00:00Z"}},
+		},
+	}, nil)
+	mockClient.On("QueryWorkflow", mock.Anything, "bill-1234-2024-08-01T00:00:00Z", mock.Anything, workflow.GetBill).Return(nil, errors.New("worker unavailable"))
+
+	resp, err := service.GetSubscriptionBills(tenantContext(testTenant), "1234", &GetSubscriptionBillsParams{})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal(summary, resp.Bills[0].Summary)
+	s.Equal([]FailedBill{{Id: "bill-1234-2024-08-01T00:00:00Z", Error: "internal: unable to get bill"}}, resp.Failed)
+	s.Empty(resp.NextCursor)
+}
+
+func (s *UnitTestSuite) Test_GetSubscriptionBills_Invalid() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		eb:     *errs.B(),
+	}
+
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, mock.Anything).Return(mockHandle)
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{TenantId: otherTenant.Id, Currency: "USD", Period: "monthly"}),
+	}, nil).Once()
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{Currency: "USD", Period: "monthly"}),
+	}, nil)
+
+	ctx := tenantContext(testTenant)
+
+	// The bills of another tenant's subscription are not listed
+	_, err := service.GetSubscriptionBills(ctx, "1234", &GetSubscriptionBillsParams{})
+	s.EqualError(err, "not_found: subscription not found")
+
+	_, err = service.GetSubscriptionBills(ctx, "1234", &GetSubscriptionBillsParams{PageSize: maxPageSize + 1})
+	s.EqualError(err, "invalid_argument: page size must be between 1 and 200")
+
+	_, err = service.GetSubscriptionBills(ctx, "1234", &GetSubscriptionBillsParams{Cursor: "not a cursor"})
+	s.EqualError(err, "invalid_argument: invalid cursor")
+}
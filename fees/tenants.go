@@ -0,0 +1,255 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/middleware"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// defaultTenantId owns the bills, customers and subscriptions created before tenants existed
+const defaultTenantId = "default"
+
+var (
+	errTenantNotFound = errors.New("tenant not found")
+	errTenantExists   = errors.New("tenant already exists")
+)
+
+type Tenant struct {
+	Id                string    `json:"id"`
+	Name              string    `json:"name"`
+	AllowedCurrencies []string  `json:"allowedCurrencies"` // bills, customers and subscriptions are limited to these
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// TenantRequest creates a tenant, or replaces its configuration when updating
+type TenantRequest struct {
+	Id                string   `json:"id"` // lowercase letters, digits and dashes
+	Name              string   `json:"name"`
+	AllowedCurrencies []string `json:"allowedCurrencies"`
+}
+
+// Tenant management is not scoped to a tenant, the middleware lets these endpoints through
+var tenantlessEndpoints = map[string]bool{
+	"CreateTenant": true,
+	"UpdateTenant": true,
+	"GetTenant":    true,
+
+	"CreateTenantApiKey": true,
+}
+
+// encore:api private method=POST path=/api/tenant
+func (s *Service) CreateTenant(ctx context.Context, req *TenantRequest) (*Tenant, error) {
+	tenant, err := s.validateTenant(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Creating tenant", "id", tenant.Id)
+
+	created, err := s.tenants.CreateTenant(ctx, tenant)
+	if errors.Is(err, errTenantExists) {
+		return nil, s.eb.Code(errs.AlreadyExists).Msg("tenant already exists").Err()
+	}
+	if err != nil {
+		rlog.Error("Error creating tenant", "id", tenant.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to create tenant").Err()
+	}
+	return created, nil
+}
+
+// encore:api private method=POST path=/api/tenant/update
+func (s *Service) UpdateTenant(ctx context.Context, req *TenantRequest) (*Tenant, error) {
+	tenant, err := s.validateTenant(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rlog.Info("Updating tenant", "id", tenant.Id)
+
+	updated, err := s.tenants.UpdateTenant(ctx, tenant)
+	if errors.Is(err, errTenantNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("tenant not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error updating tenant", "id", tenant.Id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to update tenant").Err()
+	}
+	return updated, nil
+}
+
+// encore:api private method=GET path=/api/tenant/:id
+func (s *Service) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	tenant, err := s.tenants.GetTenant(ctx, id)
+	if errors.Is(err, errTenantNotFound) {
+		return nil, s.eb.Code(errs.NotFound).Msg("tenant not found").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading tenant", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to get tenant").Err()
+	}
+	return tenant, nil
+}
+
+// TenantMiddleware checks the API key of every request can call the endpoint, and resolves the tenant the key was issued for
+// and the actor changes to bills are recorded against.
+// encore:middleware target=all
+func (s *Service) TenantMiddleware(req middleware.Request, next middleware.Next) middleware.Response {
+	data := req.Data()
+	if tenantlessEndpoints[data.Endpoint] {
+		return next(req)
+	}
+
+	key, _ := auth.Data().(*AuthData)
+	tenant, err := s.authorize(req.Context(), data.Endpoint, key)
+	if err != nil {
+		return middleware.Response{Err: err}
+	}
+	ctx := withActor(withTenant(req.Context(), tenant), requestActor(data, key))
+	return next(req.WithContext(ctx))
+}
+
+func (s *Service) resolveTenant(ctx context.Context, id string) (*Tenant, error) {
+	tenant, err := s.tenants.GetTenant(ctx, id)
+	if errors.Is(err, errTenantNotFound) {
+		return nil, s.eb.Code(errs.PermissionDenied).Msg("unknown tenant").Err()
+	}
+	if err != nil {
+		rlog.Error("Error reading tenant", "id", id, "error", err)
+		return nil, s.eb.Code(errs.Internal).Msg("unable to resolve tenant").Err()
+	}
+	return tenant, nil
+}
+
+type tenantContextKey struct{}
+
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenant returns the tenant of the request, it is set by TenantMiddleware
+func (s *Service) tenant(ctx context.Context) (*Tenant, error) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(*Tenant)
+	if !ok {
+		return nil, s.eb.Code(errs.InvalidArgument).Msg("tenant is required").Err()
+	}
+	return tenant, nil
+}
+
+// allows reports whether the tenant can raise bills in the currency
+func (t *Tenant) allows(currency string) bool {
+	return contains(t.AllowedCurrencies, currency)
+}
+
+func (s *Service) unsupportedCurrency(tenant *Tenant) error {
+	return s.eb.Code(errs.InvalidArgument).Msgf("unsupported currency, only %s", strings.Join(tenant.AllowedCurrencies, " or ")).Err()
+}
+
+// billTenant is the tenant owning the bill
+func billTenant(bill *workflow.Bill) string {
+	if bill.TenantId == "" {
+		return defaultTenantId
+	}
+	return bill.TenantId
+}
+
+// tenantBill gets the bill, bills of other tenants are not found
+func (s *Service) tenantBill(ctx context.Context, id string) (*workflow.Bill, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bill, err := s.getBill(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if billTenant(bill) != tenant.Id {
+		rlog.Warn("Bill requested by another tenant", "id", id, "tenant", tenant.Id)
+		return nil, s.eb.Code(errs.NotFound).Msg("bill not found").Err()
+	}
+	return bill, nil
+}
+
+var tenantId = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+func (s *Service) validateTenant(req *TenantRequest) (Tenant, error) {
+	tenant := Tenant{Id: req.Id, Name: strings.TrimSpace(req.Name), AllowedCurrencies: req.AllowedCurrencies}
+	if !tenantId.MatchString(tenant.Id) {
+		return tenant, s.eb.Code(errs.InvalidArgument).Msg("invalid tenant id, use lowercase letters, digits and dashes").Err()
+	}
+	if tenant.Name == "" {
+		return tenant, s.eb.Code(errs.InvalidArgument).Msg("name is required").Err()
+	}
+	if len(tenant.AllowedCurrencies) == 0 {
+		return tenant, s.eb.Code(errs.InvalidArgument).Msg("at least one currency must be allowed").Err()
+	}
+	for _, currency := range tenant.AllowedCurrencies {
+		if !contains(SupportedCurrencies, currency) {
+			return tenant, s.eb.Code(errs.InvalidArgument).Msgf("unsupported currency %s, only USD or GEL", currency).Err()
+		}
+	}
+	return tenant, nil
+}
+
+// tenantRepository stores the tenants and their configuration
+type tenantRepository interface {
+	CreateTenant(ctx context.Context, tenant Tenant) (*Tenant, error)
+	UpdateTenant(ctx context.Context, tenant Tenant) (*Tenant, error)
+	GetTenant(ctx context.Context, id string) (*Tenant, error)
+}
+
+type tenantStore struct {
+	db *sqldb.Database
+}
+
+const tenantColumns = `id, name, allowed_currencies, created_at, updated_at`
+
+func (s *tenantStore) CreateTenant(ctx context.Context, tenant Tenant) (*Tenant, error) {
+	row := s.db.QueryRow(ctx, `
+		INSERT INTO tenants (id, name, allowed_currencies)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING `+tenantColumns,
+		tenant.Id, tenant.Name, tenant.AllowedCurrencies)
+	created, err := scanTenant(row)
+	if errors.Is(err, errTenantNotFound) {
+		return nil, errTenantExists
+	}
+	return created, err
+}
+
+func (s *tenantStore) UpdateTenant(ctx context.Context, tenant Tenant) (*Tenant, error) {
+	row := s.db.QueryRow(ctx, `
+		UPDATE tenants
+		SET name = $2, allowed_currencies = $3, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+tenantColumns,
+		tenant.Id, tenant.Name, tenant.AllowedCurrencies)
+	return scanTenant(row)
+}
+
+func (s *tenantStore) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	row := s.db.QueryRow(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = $1`, id)
+	return scanTenant(row)
+}
+
+func scanTenant(row interface{ Scan(dest ...interface{}) error }) (*Tenant, error) {
+	var tenant Tenant
+	err := row.Scan(&tenant.Id, &tenant.Name, &tenant.AllowedCurrencies, &tenant.CreatedAt, &tenant.UpdatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errTenantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
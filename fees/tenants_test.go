@@ -0,0 +1,256 @@
+package fees
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"encore.app/fees/workflow"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/mocks"
+)
+
+var (
+	testTenant  = Tenant{Id: defaultTenantId, Name: "Default", AllowedCurrencies: []string{"USD", "GEL"}}
+	otherTenant = Tenant{Id: "other", Name: "Other", AllowedCurrencies: []string{"USD"}}
+)
+
+// tenantContext is the context of a request resolved to the tenant by TenantMiddleware
+func tenantContext(tenant Tenant) context.Context {
+	return withTenant(context.Background(), &tenant)
+}
+
+type fakeTenantStore struct {
+	mu      sync.Mutex
+	tenants map[string]Tenant
+}
+
+func newFakeTenantStore(tenants ...Tenant) *fakeTenantStore {
+	f := &fakeTenantStore{tenants: make(map[string]Tenant)}
+	for _, t := range tenants {
+		f.tenants[t.Id] = t
+	}
+	return f
+}
+
+func (f *fakeTenantStore) CreateTenant(ctx context.Context, tenant Tenant) (*Tenant, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tenants[tenant.Id]; ok {
+		return nil, errTenantExists
+	}
+	tenant.CreatedAt = time.Now()
+	tenant.UpdatedAt = tenant.CreatedAt
+	f.tenants[tenant.Id] = tenant
+	return &tenant, nil
+}
+
+func (f *fakeTenantStore) UpdateTenant(ctx context.Context, tenant Tenant) (*Tenant, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	existing, ok := f.tenants[tenant.Id]
+	if !ok {
+		return nil, errTenantNotFound
+	}
+	tenant.CreatedAt = existing.CreatedAt
+	tenant.UpdatedAt = time.Now()
+	f.tenants[tenant.Id] = tenant
+	return &tenant, nil
+}
+
+func (f *fakeTenantStore) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tenant, ok := f.tenants[id]
+	if !ok {
+		return nil, errTenantNotFound
+	}
+	return &tenant, nil
+}
+
+func (s *UnitTestSuite) Test_ResolveTenant() {
+	service := &Service{
+		client:  mocks.NewClient(s.T()),
+		worker:  nil,
+		tenants: newFakeTenantStore(testTenant, otherTenant),
+		eb:      *errs.B(),
+	}
+
+	ctx := context.Background()
+	tenant, err := service.resolveTenant(ctx, "other")
+	s.NoError(err)
+	s.Equal([]string{"USD"}, tenant.AllowedCurrencies)
+
+	_, err = service.resolveTenant(ctx, "unknown")
+	s.EqualError(err, "permission_denied: unknown tenant")
+
+	_, err = service.GetBills(ctx, &GetBillsParams{})
+	s.EqualError(err, "invalid_argument: tenant is required")
+}
+
+func (s *UnitTestSuite) Test_CreateTenant() {
+	service := &Service{
+		client:  mocks.NewClient(s.T()),
+		worker:  nil,
+		tenants: newFakeTenantStore(testTenant),
+		eb:      *errs.B(),
+	}
+
+	ctx := context.Background()
+	created, err := service.CreateTenant(ctx, &TenantRequest{Id: "acme-eu", Name: " Acme EU ", AllowedCurrencies: []string{"USD"}})
+	s.NoError(err)
+	s.Equal("Acme EU", created.Name)
+
+	updated, err := service.UpdateTenant(ctx, &TenantRequest{Id: "acme-eu", Name: "Acme EU", AllowedCurrencies: []string{"USD", "GEL"}})
+	s.NoError(err)
+	s.Equal([]string{"USD", "GEL"}, updated.AllowedCurrencies)
+
+	_, err = service.CreateTenant(ctx, &TenantRequest{Id: "acme-eu", Name: "Acme EU", AllowedCurrencies: []string{"USD"}})
+	s.EqualError(err, "already_exists: tenant already exists")
+
+	_, err = service.CreateTenant(ctx, &TenantRequest{Id: "Acme EU", Name: "Acme EU", AllowedCurrencies: []string{"USD"}})
+	s.EqualError(err, "invalid_argument: invalid tenant id, use lowercase letters, digits and dashes")
+
+	_, err = service.CreateTenant(ctx, &TenantRequest{Id: "acme", Name: "Acme"})
+	s.EqualError(err, "invalid_argument: at least one currency must be allowed")
+
+	_, err = service.CreateTenant(ctx, &TenantRequest{Id: "acme", Name: "Acme", AllowedCurrencies: []string{"EUR"}})
+	s.EqualError(err, "invalid_argument: unsupported currency EUR, only USD or GEL")
+
+	_, err = service.UpdateTenant(ctx, &TenantRequest{Id: "unknown", Name: "Unknown", AllowedCurrencies: []string{"USD"}})
+	s.EqualError(err, "not_found: tenant not found")
+}
+
+func (s *UnitTestSuite) Test_Tenant_BillsOfOtherTenantsNotFound() {
+	created := time.Now()
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store: newFakeBillStore(
+			workflow.Bill{Id: "1", Currency: "USD", CreatedAt: &created},
+			workflow.Bill{Id: "2", Currency: "USD", TenantId: otherTenant.Id, CreatedAt: &created},
+		),
+		eb: *errs.B(),
+	}
+
+	ctx := tenantContext(otherTenant)
+
+	bill, err := service.GetBill(ctx, "2", &GetBillParams{})
+	s.NoError(err)
+	s.Equal("2", bill.Id)
+
+	// Bills without a tenant belong to the default tenant, no signal reaches them from another tenant
+	_, err = service.GetBill(ctx, "1", &GetBillParams{})
+	s.EqualError(err, "not_found: bill not found")
+
+	_, err = service.AddLineItem(ctx, &AddLineItemRequest{BillId: "1", Description: "item1", Amount: 10.0})
+	s.EqualError(err, "not_found: bill not found")
+
+	_, err = service.CloseBill(ctx, &CloseBillRequest{Id: "1"})
+	s.EqualError(err, "not_found: bill not found")
+
+	resp, err := service.GetBills(ctx, &GetBillsParams{})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("2", resp.Bills[0].Id)
+
+	resp, err = service.GetBills(tenantContext(testTenant), &GetBillsParams{})
+	s.NoError(err)
+	s.Len(resp.Bills, 1)
+	s.Equal("1", resp.Bills[0].Id)
+}
+
+func (s *UnitTestSuite) Test_Tenant_CustomersAndCurrencies() {
+	mockClient := mocks.NewClient(s.T())
+	service := &Service{
+		client:    mockClient,
+		worker:    nil,
+		customers: newFakeCustomerStore(testCustomer, Customer{Id: "customer2", TenantId: otherTenant.Id, Name: "Basalt", DefaultCurrency: "USD"}),
+		eb:        *errs.B(),
+	}
+
+	mockWorkflowRun := mocks.NewWorkflowRun(s.T())
+	mockWorkflowRun.On("GetID").Return("123")
+	mockClient.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.MatchedBy(func(bill workflow.Bill) bool {
+		return bill.TenantId == otherTenant.Id && bill.CustomerId == "customer2"
+	})).Return(mockWorkflowRun, nil)
+
+	ctx := tenantContext(otherTenant)
+
+	_, err := service.GetCustomer(ctx, testCustomer.Id)
+	s.EqualError(err, "not_found: customer not found")
+
+	customers, err := service.GetCustomers(ctx, &GetCustomersParams{})
+	s.NoError(err)
+	s.Len(customers.Customers, 1)
+	s.Equal("customer2", customers.Customers[0].Id)
+
+	_, err = service.CreateBill(ctx, &CreateBillRequest{CustomerId: testCustomer.Id})
+	s.EqualError(err, "not_found: customer not found")
+
+	// Currencies are limited to the ones configured for the tenant
+	_, err = service.CreateBill(ctx, &CreateBillRequest{CustomerId: "customer2", Currency: "GEL"})
+	s.EqualError(err, "invalid_argument: unsupported currency, only USD")
+
+	_, err = service.CreateCustomer(ctx, &CreateCustomerRequest{Name: "Cobalt", DefaultCurrency: "GEL"})
+	s.EqualError(err, "invalid_argument: unsupported default currency, only USD")
+
+	resp, err := service.CreateBill(ctx, &CreateBillRequest{CustomerId: "customer2"})
+	s.NoError(err)
+	s.Equal("123", resp.Id)
+}
+
+func (s *UnitTestSuite) Test_Tenant_FiltersOnAllowedCurrencies() {
+	service := &Service{
+		client: mocks.NewClient(s.T()),
+		worker: nil,
+		store:  newFakeBillStore(),
+		eb:     *errs.B(),
+	}
+
+	// Filters are limited to the currencies the tenant can raise bills in
+	ctx := tenantContext(otherTenant)
+	_, err := service.GetBills(ctx, &GetBillsParams{Currency: "GEL"})
+	s.EqualError(err, "invalid_argument: unsupported currency, only USD")
+
+	_, err = service.GetBillStats(ctx, &GetBillStatsParams{Currency: "GEL"})
+	s.EqualError(err, "invalid_argument: unsupported currency, only USD")
+
+	_, err = service.RebuildBills(ctx, &RebuildBillsRequest{Currency: "GEL"})
+	s.EqualError(err, "invalid_argument: unsupported currency, only USD")
+}
+
+func (s *UnitTestSuite) Test_Tenant_SubscriptionsOfOtherTenantsNotFound() {
+	mockClient := mocks.NewClient(s.T())
+	mockScheduleClient := mocks.NewScheduleClient(s.T())
+	mockHandle := mocks.NewScheduleHandle(s.T())
+	service := &Service{
+		client: mockClient,
+		worker: nil,
+		eb:     *errs.B(),
+	}
+
+	mockClient.On("ScheduleClient").Return(mockScheduleClient)
+	mockScheduleClient.On("GetHandle", mock.Anything, "1234").Return(mockHandle)
+	mockHandle.On("Describe", mock.Anything).Return(&client.ScheduleDescription{
+		Memo: mockSubscriptionMemo(Subscription{TenantId: otherTenant.Id, Currency: "USD", Period: "monthly"}),
+	}, nil)
+
+	// Cancelling is refused before the schedule is deleted
+	err := service.CancelSubscription(tenantContext(testTenant), &SubscriptionRequest{Id: "1234"})
+	s.EqualError(err, "not_found: subscription not found")
+
+	sub, err := service.GetSubscription(tenantContext(otherTenant), "1234")
+	s.NoError(err)
+	s.Equal(otherTenant.Id, sub.TenantId)
+}
+
+func (s *UnitTestSuite) Test_BillVisibilityQuery_Tenant() {
+	query := billVisibilityQuery(billFilter{TenantId: defaultTenantId})
+	s.Equal(`WorkflowType = 'BillWorkflow' AND ExecutionStatus != 'ContinuedAsNew' AND (BillTenantId = 'default' OR BillTenantId IS NULL)`, query.String())
+
+	query = billVisibilityQuery(billFilter{TenantId: otherTenant.Id})
+	s.Equal(`WorkflowType = 'BillWorkflow' AND ExecutionStatus != 'ContinuedAsNew' AND BillTenantId = 'other'`, query.String())
+}
@@ -1,5 +1,11 @@
 package fees
 
+import (
+	"errors"
+
+	"go.temporal.io/api/serviceerror"
+)
+
 func contains(arr []string, str string) bool {
 	for _, s := range arr {
 			if s == str {
@@ -7,4 +13,14 @@ func contains(arr []string, str string) bool {
 			}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+func isNotFound(err error) bool {
+	var notFound *serviceerror.NotFound
+	return errors.As(err, &notFound)
+}
+
+func isAlreadyStarted(err error) bool {
+	var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+	return errors.As(err, &alreadyStarted)
+}
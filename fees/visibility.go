@@ -0,0 +1,52 @@
+package fees
+
+import (
+	"fmt"
+	"strings"
+
+	"encore.app/fees/workflow"
+)
+
+// visibilityQuery builds a Temporal list filter, values are always quoted so user input cannot change the query
+type visibilityQuery struct {
+	conditions []string
+}
+
+// add appends a condition, each %s in the format is replaced with the quoted value at the same position
+func (q *visibilityQuery) add(format string, values ...string) {
+	quoted := make([]interface{}, len(values))
+	for i, v := range values {
+		quoted[i] = quoteVisibilityValue(v)
+	}
+	q.conditions = append(q.conditions, fmt.Sprintf(format, quoted...))
+}
+
+// equals adds an equality condition on the attribute unless the value is empty
+func (q *visibilityQuery) equals(attribute string, value string) {
+	if value != "" {
+		q.add(attribute+" = %s", value)
+	}
+}
+
+// tenant matches the bills and subscriptions of the tenant. Those created before tenants existed belong to the
+// default tenant and do not index one.
+func (q *visibilityQuery) tenant(tenantId string) {
+	key := workflow.TenantIdKey.GetName()
+	switch tenantId {
+	case "":
+	case defaultTenantId:
+		q.add("("+key+" = %s OR "+key+" IS NULL)", defaultTenantId)
+	default:
+		q.equals(key, tenantId)
+	}
+}
+
+func (q *visibilityQuery) String() string {
+	return strings.Join(q.conditions, " AND ")
+}
+
+var visibilityValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func quoteVisibilityValue(value string) string {
+	return "'" + visibilityValueEscaper.Replace(value) + "'"
+}
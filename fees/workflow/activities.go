@@ -0,0 +1,40 @@
+package workflow
+
+import "context"
+
+// BillStore persists the read model of bills, it is implemented by the fees service
+type BillStore interface {
+	SaveBill(ctx context.Context, bill Bill) error
+}
+
+// BillArchive keeps closed bills beyond the retention of their workflow history, it is implemented by the fees service
+type BillArchive interface {
+	ArchiveBill(ctx context.Context, bill Bill) error
+}
+
+// BillLedger appends the events of bills to their ledger, it is implemented by the fees service
+type BillLedger interface {
+	AppendEvents(ctx context.Context, events []BillEvent) error
+}
+
+// Activities are the side effects of the bill workflow, registered on the worker with their dependencies
+type Activities struct {
+	Store   BillStore
+	Archive BillArchive
+	Ledger  BillLedger
+}
+
+// ProjectBill writes the current state of the bill to the read model
+func (a *Activities) ProjectBill(ctx context.Context, bill Bill) error {
+	return a.Store.SaveBill(ctx, bill)
+}
+
+// ArchiveBill stores the final state of a closed bill
+func (a *Activities) ArchiveBill(ctx context.Context, bill Bill) error {
+	return a.Archive.ArchiveBill(ctx, bill)
+}
+
+// RecordBillEvents appends the events to the bill's ledger, events already recorded are skipped
+func (a *Activities) RecordBillEvents(ctx context.Context, events []BillEvent) error {
+	return a.Ledger.AppendEvents(ctx, events)
+}
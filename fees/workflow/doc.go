@@ -0,0 +1,11 @@
+// Package workflow contains the bill workflow and the types it shares with the fees service.
+//
+// Workflow code must be deterministic, it is replayed from history whenever a worker picks up a bill.
+// Use workflow.Now instead of time.Now and the workflow logger instead of rlog.
+//
+// Any change to the commands BillWorkflow produces (timers, activities, child workflows, search
+// attributes, ...) must be guarded with workflow.GetVersion so bills already running keep replaying
+// the old code path. Declare a constant for the change ID, branch on the returned version, and add the
+// history of a bill that ran the new code to testdata/histories so the replay suite covers it.
+// Old branches can only be removed once no running bill can still replay them.
+package workflow
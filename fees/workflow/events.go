@@ -0,0 +1,81 @@
+package workflow
+
+import (
+	"fmt"
+	"time"
+)
+
+// Types of the events recorded in a bill's ledger
+const (
+	EventCreated      = "created"
+	EventItemAdded    = "item_added"
+	EventItemRejected = "item_rejected"
+	EventItemVoided   = "item_voided"
+	EventClosed       = "closed"
+)
+
+// BillEvent is an immutable change to a bill. Events are numbered by the bill version they produced,
+// so the events of a bill are ordered and a retried activity cannot record the same change twice.
+type BillEvent struct {
+	BillId     string    `json:"billId"`
+	Sequence   int       `json:"sequence"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Bill       *Bill     `json:"bill,omitempty"`   // created, the bill as it was created
+	Item       *LineItem `json:"item,omitempty"`   // item_added, item_rejected, item_voided
+	Reason     string    `json:"reason,omitempty"` // item_rejected, item_voided
+	Actor      *Actor    `json:"actor,omitempty"`  // who made the change, empty for late fees
+	// InterestPeriod is the period an interest item_added charged. Periods with nothing to charge add no item,
+	// so the period is recorded rather than counted from the events.
+	InterestPeriod int `json:"interestPeriod,omitempty"`
+}
+
+// Apply changes the bill as the event did. Folding the events of a bill in order, starting from
+// the created event, rebuilds the bill as it was at the version of the last event applied.
+func (bill *Bill) Apply(event BillEvent) {
+	switch event.Type {
+	case EventCreated:
+		if event.Bill != nil {
+			*bill = *event.Bill
+			bill.LineItems = append([]LineItem{}, event.Bill.LineItems...)
+			bill.RejectedItems = append([]RejectedLineItem(nil), event.Bill.RejectedItems...)
+		}
+	case EventItemAdded:
+		if event.Item != nil {
+			bill.AddLineItem(*event.Item)
+			switch event.Item.Type {
+			case LineItemLateFee:
+				bill.LateFees.FlatFeeCharged = true
+			case LineItemInterest:
+				bill.LateFees.InterestPeriods = bill.interestPeriod(event)
+				bill.LateFees.InterestCharged += event.Item.Amount
+			}
+		}
+	case EventItemVoided:
+		if event.Item != nil {
+			bill.VoidLineItem(event.Item.Id, event.Reason, event.OccurredAt)
+		}
+	case EventItemRejected:
+		if event.Item != nil {
+			bill.RejectedItems = append(bill.RejectedItems, RejectedLineItem{LineItem: *event.Item, Reason: event.Reason})
+		}
+	case EventClosed:
+		closedOn := event.OccurredAt
+		bill.ClosedOn = &closedOn
+	}
+	bill.Id = event.BillId
+	bill.Version = event.Sequence
+}
+
+// interestPeriod is the period the interest event charged. Events recorded before the period was part of
+// the event carry it in the item id instead, which ApplyLateFees numbers by period.
+func (bill *Bill) interestPeriod(event BillEvent) int {
+	if event.InterestPeriod > 0 {
+		return event.InterestPeriod
+	}
+	var period int
+	if _, err := fmt.Sscanf(event.Item.Id, interestItemId, &period); err == nil && period > 0 {
+		return period
+	}
+	return bill.LateFees.InterestPeriods + 1
+}
@@ -0,0 +1,162 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	InterestDaily   = "daily"
+	InterestMonthly = "monthly"
+)
+
+// interestItemId is the id of the interest line item charged for a period
+const interestItemId = "interest-%d"
+
+// LateCharge is a late line item added by ApplyLateFees
+type LateCharge struct {
+	Item           LineItem
+	InterestPeriod int // the period an interest item charges, zero for the flat fee
+}
+
+// LateFeePolicy configures the charges applied to a bill once it is past its due date.
+type LateFeePolicy struct {
+	FlatFee        float64 `json:"flatFee"`        // charged once, GraceDays after the due date
+	GraceDays      int     `json:"graceDays"`
+	InterestRate   float64 `json:"interestRate"`   // fraction of the fees charged per period, e.g. 0.01
+	InterestPeriod string  `json:"interestPeriod"` // daily, monthly
+	MaxInterest    float64 `json:"maxInterest"`    // total interest charged will never exceed this
+}
+
+// LateFeeState tracks which late charges have already been applied to a bill.
+type LateFeeState struct {
+	FlatFeeCharged  bool    `json:"flatFeeCharged"`
+	InterestPeriods int     `json:"interestPeriods"`
+	InterestCharged float64 `json:"interestCharged"`
+}
+
+func (p LateFeePolicy) Validate() error {
+	if p.FlatFee < 0 || p.InterestRate < 0 || p.MaxInterest < 0 {
+		return errors.New("late fee amounts must not be negative")
+	}
+	if p.GraceDays < 0 {
+		return errors.New("grace days must not be negative")
+	}
+	if p.InterestRate > 0 {
+		if p.InterestPeriod != InterestDaily && p.InterestPeriod != InterestMonthly {
+			return errors.New("interest period must be daily or monthly")
+		}
+		if p.MaxInterest == 0 {
+			return errors.New("max interest is required when charging interest")
+		}
+	}
+	return nil
+}
+
+func (p LateFeePolicy) flatFeeAt(due time.Time) time.Time {
+	return due.AddDate(0, 0, p.GraceDays)
+}
+
+func (p LateFeePolicy) interestAt(due time.Time, period int) time.Time {
+	if p.InterestPeriod == InterestMonthly {
+		return due.AddDate(0, period, 0)
+	}
+	return due.AddDate(0, 0, period)
+}
+
+// NextLateFeeAt returns when the next late charge falls due, if there is one left to apply.
+func (bill *Bill) NextLateFeeAt() (time.Time, bool) {
+	if bill.DueDate == nil || bill.LateFeePolicy == nil {
+		return time.Time{}, false
+	}
+	p, s := bill.LateFeePolicy, bill.LateFees
+
+	var next time.Time
+	found := false
+	if p.FlatFee > 0 && !s.FlatFeeCharged {
+		next, found = p.flatFeeAt(*bill.DueDate), true
+	}
+	if p.InterestRate > 0 && s.InterestCharged < p.MaxInterest {
+		at := p.interestAt(*bill.DueDate, s.InterestPeriods+1)
+		if !found || at.Before(next) {
+			next, found = at, true
+		}
+	}
+	return next, found
+}
+
+// AccruesLateFees reports whether late charges are left to fall due on a closed bill. Closed bills keep being charged
+// until the flat fee and the interest up to its cap have been. Their fees no longer change, so interest is only left
+// when there are fees to charge it on.
+func (bill *Bill) AccruesLateFees() bool {
+	if bill.DueDate == nil || bill.LateFeePolicy == nil {
+		return false
+	}
+	p, s := bill.LateFeePolicy, bill.LateFees
+	if p.FlatFee > 0 && !s.FlatFeeCharged {
+		return true
+	}
+	return p.InterestRate > 0 && s.InterestCharged < p.MaxInterest && bill.feesTotal() > 0
+}
+
+// ApplyLateFees adds every late charge that has fallen due by now as a line item, and returns them in order.
+// Interest periods with nothing to charge are passed without adding an item.
+func (bill *Bill) ApplyLateFees(now time.Time) []LateCharge {
+	charges := make([]LateCharge, 0)
+	for {
+		at, ok := bill.NextLateFeeAt()
+		if !ok || at.After(now) {
+			return charges
+		}
+
+		p := bill.LateFeePolicy
+		chargedAt := at
+		if !bill.LateFees.FlatFeeCharged && p.FlatFee > 0 && !p.flatFeeAt(*bill.DueDate).After(at) {
+			bill.LateFees.FlatFeeCharged = true
+			item := LineItem{
+				Id:          "late-fee",
+				Description: fmt.Sprintf("Late fee (%d days overdue)", p.GraceDays),
+				Amount:      p.FlatFee,
+				Type:        LineItemLateFee,
+				CreatedAt:   &chargedAt,
+			}
+			bill.AddLineItem(item)
+			charges = append(charges, LateCharge{Item: item})
+			continue
+		}
+
+		bill.LateFees.InterestPeriods++
+		amount := roundToCents(bill.feesTotal() * p.InterestRate)
+		if remaining := p.MaxInterest - bill.LateFees.InterestCharged; amount > remaining {
+			amount = remaining
+		}
+		if amount <= 0 {
+			continue
+		}
+		bill.LateFees.InterestCharged += amount
+		item := LineItem{
+			Id:          fmt.Sprintf(interestItemId, bill.LateFees.InterestPeriods),
+			Description: fmt.Sprintf("Interest (%s period %d, %g%%)", p.InterestPeriod, bill.LateFees.InterestPeriods, p.InterestRate*100),
+			Amount:      amount,
+			Type:        LineItemInterest,
+			CreatedAt:   &chargedAt,
+		}
+		bill.AddLineItem(item)
+		charges = append(charges, LateCharge{Item: item, InterestPeriod: bill.LateFees.InterestPeriods})
+	}
+}
+
+// feesTotal sums the regular fees on the bill, which is what interest is charged on.
+func (bill *Bill) feesTotal() float64 {
+	total := 0.0
+	for _, item := range bill.LineItems {
+		if item.VoidedAt != nil {
+			continue
+		}
+		if item.Type == LineItemFee || item.Type == "" {
+			total += item.Amount
+		}
+	}
+	return total
+}
@@ -0,0 +1,90 @@
+package workflow
+
+import (
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	StatusOpen   = "open"
+	StatusClosed = "closed"
+)
+
+// Search attributes indexed for every bill, they must be registered with the Temporal namespace
+var (
+	CurrencyKey      = temporal.NewSearchAttributeKeyKeyword("BillCurrency")
+	TotalAmountKey   = temporal.NewSearchAttributeKeyFloat64("BillTotalAmount")
+	CustomerIdKey    = temporal.NewSearchAttributeKeyKeyword("BillCustomerId")
+	LineItemCountKey = temporal.NewSearchAttributeKeyInt64("BillLineItemCount")
+	StatusKey        = temporal.NewSearchAttributeKeyKeyword("BillStatus")
+	ClosedOnKey      = temporal.NewSearchAttributeKeyTime("BillClosedOn")
+	TenantIdKey      = temporal.NewSearchAttributeKeyKeyword("BillTenantId")
+)
+
+// Status is open until the bill is closed
+func (bill *Bill) Status() string {
+	if bill.ClosedOn != nil {
+		return StatusClosed
+	}
+	return StatusOpen
+}
+
+// searchAttributes is the indexed view of a bill, compared between updates so unchanged bills are not upserted
+type searchAttributes struct {
+	currency      string
+	totalAmount   float64
+	customerId    string
+	tenantId      string
+	lineItemCount int
+	status        string
+	closedOn      time.Time
+}
+
+func (bill *Bill) searchAttributes() searchAttributes {
+	a := searchAttributes{
+		currency:      bill.Currency,
+		totalAmount:   bill.TotalAmount,
+		customerId:    bill.CustomerId,
+		tenantId:      bill.TenantId,
+		lineItemCount: bill.LineItemCount(),
+		status:        bill.Status(),
+	}
+	if bill.ClosedOn != nil {
+		a.closedOn = *bill.ClosedOn
+	}
+	return a
+}
+
+func (a searchAttributes) updates() []temporal.SearchAttributeUpdate {
+	updates := []temporal.SearchAttributeUpdate{
+		CurrencyKey.ValueSet(a.currency),
+		TotalAmountKey.ValueSet(a.totalAmount),
+		LineItemCountKey.ValueSet(int64(a.lineItemCount)),
+		StatusKey.ValueSet(a.status),
+	}
+	if a.customerId != "" {
+		updates = append(updates, CustomerIdKey.ValueSet(a.customerId))
+	}
+	if a.tenantId != "" {
+		updates = append(updates, TenantIdKey.ValueSet(a.tenantId))
+	}
+	if !a.closedOn.IsZero() {
+		updates = append(updates, ClosedOnKey.ValueSet(a.closedOn))
+	}
+	return updates
+}
+
+// upsertSearchAttributes indexes the bill if it changed since the last upsert
+func upsertSearchAttributes(ctx workflow.Context, bill *Bill, last *searchAttributes) error {
+	a := bill.searchAttributes()
+	if a == *last {
+		return nil
+	}
+	if err := workflow.UpsertTypedSearchAttributes(ctx, a.updates()...); err != nil {
+		return err
+	}
+	*last = a
+	return nil
+}
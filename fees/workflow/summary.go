@@ -0,0 +1,36 @@
+package workflow
+
+import "go.temporal.io/sdk/workflow"
+
+// SummaryMemoKey is the memo field holding the bill's BillSummary
+const SummaryMemoKey = "summary"
+
+// BillSummary is the compact view of a bill kept in its memo, so listing bill workflows needs no query per bill
+type BillSummary struct {
+	Currency      string  `json:"currency"`
+	TotalAmount   float64 `json:"totalAmount"`
+	LineItemCount int     `json:"lineItemCount"`
+	Status        string  `json:"status"`
+}
+
+func (bill *Bill) Summary() BillSummary {
+	return BillSummary{
+		Currency:      bill.Currency,
+		TotalAmount:   bill.TotalAmount,
+		LineItemCount: bill.LineItemCount(),
+		Status:        bill.Status(),
+	}
+}
+
+// upsertSummaryMemo updates the memo if the summary changed since the last upsert
+func upsertSummaryMemo(ctx workflow.Context, bill *Bill, last *BillSummary) error {
+	summary := bill.Summary()
+	if summary == *last {
+		return nil
+	}
+	if err := workflow.UpsertMemo(ctx, map[string]interface{}{SummaryMemoKey: summary}); err != nil {
+		return err
+	}
+	*last = summary
+	return nil
+}
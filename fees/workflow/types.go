@@ -2,12 +2,29 @@ package workflow
 
 import "time"
 
+// Actor identifies who made a change to a bill, it is recorded on the change in the bill's ledger
+type Actor struct {
+	Principal string `json:"principal"` // the API key the request was authenticated with
+	ClientIp  string `json:"clientIp"`
+	RequestId string `json:"requestId"`
+}
+
 type AddLineItemSignal struct {
+	Id          string
 	Description string
 	Amount      float64
+	Actor       Actor
+}
+
+type CloseBillSignal struct {
+	Actor Actor
 }
 
-type CloseBillSignal struct{}
+type VoidLineItemSignal struct {
+	ItemId string
+	Reason string
+	Actor  Actor
+}
 
 type Bill struct {
 	Id 			string `json:"id"`
@@ -16,10 +33,44 @@ type Bill struct {
 	TotalAmount 	 float64 `json:"totalAmount"`
 	CreatedAt *time.Time `json:"createdAt"`
 	ClosedOn   *time.Time `json:"closedOn"`
+	DueDate    *time.Time `json:"dueDate"`
+	LateFeePolicy *LateFeePolicy `json:"lateFeePolicy"`
+	LateFees   LateFeeState `json:"lateFees"`
+	CustomerId string `json:"customerId"`
+	TenantId   string `json:"tenantId"` // empty for bills created before tenants existed
+	SubscriptionId string `json:"subscriptionId"` // set when the bill was started by a subscription
+	Period     string `json:"period"` // billing period as YYYY-MM, set when the bill was created for one
+	CreatedBy  *Actor `json:"createdBy,omitempty"` // empty for bills started by subscriptions
+	RejectedItems []RejectedLineItem `json:"rejectedItems"`
+	Version    int `json:"version"` // incremented on every change to the bill
+}
+
+const (
+	LineItemFee      = "fee"
+	LineItemLateFee  = "late_fee"
+	LineItemInterest = "interest"
+	LineItemConsolidated = "consolidated" // a closed bill of a child account, rolled up into its parent's bill
+)
+
+// BillReference links a consolidated line item to the child account bill it rolls up
+type BillReference struct {
+	BillId     string `json:"billId"`
+	CustomerId string `json:"customerId"`
 }
 
 type LineItem struct {
+	Id          string `json:"id"`
 	Description string `json:"description"`
 	Amount      float64 `json:"amount"`
+	Type        string `json:"type"` // fee, late_fee, interest, consolidated
 	CreatedAt   *time.Time `json:"createdAt"`
-}
\ No newline at end of file
+	VoidedAt    *time.Time `json:"voidedAt"` // voided items stay on the bill but no longer count towards its total
+	VoidReason  string `json:"voidReason"`
+	Source      *BillReference `json:"source,omitempty"` // set on consolidated items
+}
+
+// RejectedLineItem is a line item that reached the bill after it was closed
+type RejectedLineItem struct {
+	LineItem
+	Reason string `json:"reason"`
+}
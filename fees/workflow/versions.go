@@ -0,0 +1,30 @@
+package workflow
+
+// Change IDs for workflow.GetVersion, one per change to the commands BillWorkflow produces.
+// Never rename or reuse an ID, running bills have it recorded in their history.
+const (
+	// Bills are projected into the fees database through the ProjectBill activity
+	projectionChange = "bill-projection"
+
+	// Bills upsert typed search attributes so they can be filtered through visibility queries
+	searchAttributesChange = "bill-search-attributes"
+
+	// Bills keep a summary in their memo so listing workflows does not need a query per bill
+	summaryMemoChange = "bill-summary-memo"
+
+	// Closed bills are archived through the ArchiveBill activity
+	archiveChange = "bill-archive"
+
+	// Every change to a bill is recorded in its ledger through the RecordBillEvents activity
+	ledgerChange = "bill-ledger"
+
+	// Closed bills reject the line items signalled while their last changes are saved, until none are left
+	closedSignalsChange = "bill-closed-signals"
+
+	// Bills continuing as new project and index the signals applied before the state is carried over,
+	// so a bill closed by one of them is not left open in the read model
+	drainProjectionChange = "bill-drain-projection"
+
+	// Closed bills keep charging late fees until none are left to fall due, then complete
+	lateFeesAfterCloseChange = "bill-late-fees-after-close"
+)
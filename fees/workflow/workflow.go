@@ -4,7 +4,7 @@ import (
 	"math"
 	"time"
 
-	"encore.dev/rlog"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
@@ -12,68 +12,418 @@ const (
 	CloseBill = "closeBill"
 	AddLineItem = "addLineItem"
 	GetBill = "getBill"
+	VoidLineItem = "voidLineItem"
+)
+
+// Activities are retried with backoff until they succeed, the read model and the ledger must not miss a change
+var activityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: 10 * time.Second,
+	RetryPolicy: &temporal.RetryPolicy{
+		InitialInterval:    time.Second,
+		BackoffCoefficient: 2.0,
+		MaximumInterval:    time.Minute,
+	},
+}
+
+// Archiving is retried for a few minutes, after which the workflow logs the failure and completes.
+// A bill missing from the archive can still be listed from the read model.
+var archiveOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: 10 * time.Second,
+	RetryPolicy: &temporal.RetryPolicy{
+		InitialInterval:    time.Second,
+		BackoffCoefficient: 2.0,
+		MaximumInterval:    time.Minute,
+		MaximumAttempts:    10,
+	},
+}
+
+// Thresholds after which a bill continues as new, well below Temporal's history limits
+var (
+	MaxHistoryLength = 10000
+	MaxLineItemsPerRun = 1000
 )
 
 // BillWorkflow models the lifecycle of a bill
 func BillWorkflow(ctx workflow.Context, b Bill) (Bill,error) {
-	rlog.Info("Bill workflow started", "id", workflow.GetInfo(ctx).WorkflowExecution.ID, "currency", b.Currency)	
+	// The workflow logger skips logging while replaying history
+	logger := workflow.GetLogger(ctx)
+	logger.Info("Bill workflow started", "id", workflow.GetInfo(ctx).WorkflowExecution.ID, "currency", b.Currency)	
 
 	err := workflow.SetQueryHandler(ctx, GetBill, func() (Bill, error) {
-		rlog.Debug("Querying bill")
+		logger.Debug("Querying bill")
 		return b, nil
 	})
 	if err != nil {
-		rlog.Error("Error setting query handler", "error", err)
+		logger.Error("Error setting query handler", "error", err)
 		return b, err
 	}
 
-	closed := false
-	
+	// Bills started by a subscription schedule are created when the schedule fires
+	b.Id = workflow.GetInfo(ctx).WorkflowExecution.ID
+	if b.CreatedAt == nil {
+		now := workflow.Now(ctx)
+		b.CreatedAt = &now
+	}
+
+	// Bills started before the read model existed are only available through the getBill query
+	projected := workflow.GetVersion(ctx, projectionChange, workflow.DefaultVersion, 1) == 1
+	activityCtx := workflow.WithActivityOptions(ctx, activityOptions)
+
+	project := func() {
+		if !projected {
+			return
+		}
+		var a *Activities
+		err := workflow.ExecuteActivity(activityCtx, a.ProjectBill, b).Get(ctx, nil)
+		if err != nil {
+			logger.Error("Error projecting bill", "error", err)
+		}
+	}
+
+	// Bills started before search attributes were indexed can only be filtered by workflow status
+	indexed := workflow.GetVersion(ctx, searchAttributesChange, workflow.DefaultVersion, 1) == 1
+	summarized := workflow.GetVersion(ctx, summaryMemoChange, workflow.DefaultVersion, 1) == 1
+	archived := workflow.GetVersion(ctx, archiveChange, workflow.DefaultVersion, 1) == 1
+	ledgered := workflow.GetVersion(ctx, ledgerChange, workflow.DefaultVersion, 1) == 1
+	settled := workflow.GetVersion(ctx, closedSignalsChange, workflow.DefaultVersion, 1) == 1
+	drainProjected := workflow.GetVersion(ctx, drainProjectionChange, workflow.DefaultVersion, 1) == 1
+	accruing := workflow.GetVersion(ctx, lateFeesAfterCloseChange, workflow.DefaultVersion, 1) == 1
+	var lastIndexed searchAttributes
+	var lastSummary BillSummary
+
+	index := func() {
+		if indexed {
+			if err := upsertSearchAttributes(ctx, &b, &lastIndexed); err != nil {
+				logger.Error("Error upserting search attributes", "error", err)
+			}
+		}
+		if summarized {
+			if err := upsertSummaryMemo(ctx, &b, &lastSummary); err != nil {
+				logger.Error("Error upserting summary memo", "error", err)
+			}
+		}
+	}
+
+	// Events are recorded once the change has been applied, in the order they happened
+	var pending []BillEvent
+
+	recordAt := func(version int, event BillEvent) {
+		if !ledgered {
+			return
+		}
+		event.BillId = b.Id
+		event.Sequence = version
+		event.OccurredAt = workflow.Now(ctx)
+		pending = append(pending, event)
+	}
+
+	// record numbers the event with the version of the bill the change produced
+	record := func(event BillEvent) {
+		recordAt(b.Version, event)
+	}
+
+	// Events that could not be recorded are kept and recorded with the next change
+	recordEvents := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var a *Activities
+		err := workflow.ExecuteActivity(activityCtx, a.RecordBillEvents, pending).Get(ctx, nil)
+		if err != nil {
+			logger.Error("Error recording bill events", "error", err)
+			return
+		}
+		pending = nil
+	}
+
+	// Runs continued as new carry on the same bill
+	if workflow.GetInfo(ctx).ContinuedExecutionRunID == "" {
+		created := b
+		record(BillEvent{Type: EventCreated, Bill: &created, Actor: b.CreatedBy})
+	}
+
+	project()
+	index()
+	recordEvents()
+
+	// Runs continued as new after the bill closed only have its late fees left to charge
+	closed := b.ClosedOn != nil
+	itemsThisRun := 0
+
 	closeChan := workflow.GetSignalChannel(ctx, CloseBill)
 	addLineItemChan := workflow.GetSignalChannel(ctx, AddLineItem)
+	voidLineItemChan := workflow.GetSignalChannel(ctx, VoidLineItem)
+
+	// rejectBuffered rejects the line items buffered on a closed bill, reporting whether there were any signals.
+	// Voids are left as they are, the bill is closed.
+	rejectBuffered := func() bool {
+		received := false
+		var add AddLineItemSignal
+		for addLineItemChan.ReceiveAsync(&add) {
+			received = true
+			logger.Info("Rejected line item on closed bill", "id", add.Id, "description", add.Description)
+			now := workflow.Now(ctx)
+			actor := add.Actor
+			rejected := RejectedLineItem{
+				LineItem: LineItem{
+					Id:          add.Id,
+					Description: add.Description,
+					Amount:      add.Amount,
+					Type:        LineItemFee,
+					CreatedAt:   &now,
+				},
+				Reason: "bill is closed",
+			}
+			b.RejectedItems = append(b.RejectedItems, rejected)
+			b.Version++
+			record(BillEvent{Type: EventItemRejected, Item: &rejected.LineItem, Reason: rejected.Reason, Actor: &actor})
+		}
+		var void VoidLineItemSignal
+		for voidLineItemChan.ReceiveAsync(&void) {
+			received = true
+			logger.Warn("Ignored void on closed bill", "id", void.ItemId)
+		}
+		return received
+	}
+
+	closeBill := func(signal CloseBillSignal) {
+		logger.Info("Received close bill signal", "actor", signal.Actor.Principal)
+		now := workflow.Now(ctx)
+		b.ClosedOn = &now
+		closed = true
+		b.Version++
+		record(BillEvent{Type: EventClosed, Actor: &signal.Actor})
+
+		// Line items still buffered behind the close are rejected rather than silently dropped
+		rejectBuffered()
+	}
+
+	// settle saves the line items rejected by a closed bill. The activities let more signals in,
+	// so it repeats until none are left and the workflow can complete without dropping any.
+	settle := func() {
+		if !settled {
+			return
+		}
+		for rejectBuffered() {
+			project()
+			index()
+			recordEvents()
+		}
+	}
+
+	addLineItem := func(signal AddLineItemSignal) {
+		logger.Info("Received add line item signal", "description", signal.Description, "amount", signal.Amount)
+		now := workflow.Now(ctx)
+		item := LineItem{
+			Id:          signal.Id,
+			Description: signal.Description,
+			Amount:      signal.Amount,
+			Type:        LineItemFee,
+			CreatedAt:   &now,
+		}
+		b.AddLineItem(item)
+		record(BillEvent{Type: EventItemAdded, Item: &item, Actor: &signal.Actor})
+		itemsThisRun++
+		logger.Info("Bill total amount updated", "totalAmount", b.TotalAmount, "lineItems", b.LineItems)
+	}
+
+	voidLineItem := func(signal VoidLineItemSignal) {
+		logger.Info("Received void line item signal", "id", signal.ItemId, "reason", signal.Reason)
+		item, ok := b.VoidLineItem(signal.ItemId, signal.Reason, workflow.Now(ctx))
+		if !ok {
+			logger.Warn("Line item to void not found or already voided", "id", signal.ItemId)
+			return
+		}
+		record(BillEvent{Type: EventItemVoided, Item: &item, Reason: signal.Reason, Actor: &signal.Actor})
+	}
+
+	// Durable timer for the next late fee, only set once the bill has a due date
+	var lateFeeTimer workflow.Future
+
+	// awaitLateFees adds the timer for the next late fee to the selector, if there is one left,
+	// and applies the late fees that have fallen due when it fires
+	awaitLateFees := func(selector workflow.Selector) {
+		if lateFeeTimer == nil {
+			at, ok := b.NextLateFeeAt()
+			if !ok {
+				return
+			}
+			wait := at.Sub(workflow.Now(ctx))
+			if wait < 0 {
+				wait = 0
+			}
+			lateFeeTimer = workflow.NewTimer(ctx, wait)
+		}
+		selector.AddFuture(lateFeeTimer, func(f workflow.Future) {
+			lateFeeTimer = nil
+			charges := b.ApplyLateFees(workflow.Now(ctx))
+			// Each late charge is its own change, numbered by the version it produced
+			first := b.Version - len(charges) + 1
+			for i, charge := range charges {
+				charge := charge
+				recordAt(first+i, BillEvent{Type: EventItemAdded, Item: &charge.Item, InterestPeriod: charge.InterestPeriod})
+			}
+			logger.Info("Applied late fees", "totalAmount", b.TotalAmount, "lateFees", b.LateFees)
+		})
+	}
 
 	// Workflow loop to keep listening for signals until the bill is closed
-	for {
+	for !closed {
 			// Create a selector to listen for signals
 			selector := workflow.NewSelector(ctx)
 
+			// Apply any late fees that have fallen due when the timer fires
+			awaitLateFees(selector)
+
 			// Register the signal handler for closing the bill
 			selector.AddReceive(closeChan, func(c workflow.ReceiveChannel, more bool) {
 				var signal CloseBillSignal
 				c.Receive(ctx, &signal)
-				rlog.Info("Received close bill signal")
-				now := time.Now()
-				b.ClosedOn = &now
-				closed = true
+				closeBill(signal)
 			})
 
 			// Register the signal handler for adding a line item
 			selector.AddReceive(addLineItemChan, func(c workflow.ReceiveChannel, more bool) {
 				var signal AddLineItemSignal
 				c.Receive(ctx, &signal)
-				rlog.Info("Received add line item signal", "description", signal.Description, "amount", signal.Amount)
-				now := time.Now()
-				b.AddLineItem(LineItem{
-					Description: signal.Description,
-					Amount:      signal.Amount,
-					CreatedAt:   &now,
-				})
-				rlog.Info("Bill total amount updated", "totalAmount", b.TotalAmount, "lineItems", b.LineItems)
+				addLineItem(signal)
+			})
+
+			// Register the signal handler for voiding a line item
+			selector.AddReceive(voidLineItemChan, func(c workflow.ReceiveChannel, more bool) {
+				var signal VoidLineItemSignal
+				c.Receive(ctx, &signal)
+				voidLineItem(signal)
 			})
 
 			// Wait for any of the registered events
 			selector.Select(ctx)
+			project()
+			index()
+			recordEvents()
+
+			// Keep the history of busy bills bounded by carrying the state over to a new run
+			if !closed && shouldContinueAsNew(ctx, itemsThisRun) {
+					// Signals already delivered to this run would be lost, so apply them first
+					var signal AddLineItemSignal
+					for addLineItemChan.ReceiveAsync(&signal) {
+							addLineItem(signal)
+					}
+					var void VoidLineItemSignal
+					for voidLineItemChan.ReceiveAsync(&void) {
+							voidLineItem(void)
+					}
+					var closeSignal CloseBillSignal
+					if closeChan.ReceiveAsync(&closeSignal) {
+							closeBill(closeSignal)
+					}
+
+					if drainProjected {
+							project()
+							index()
+					}
+					recordEvents()
+					if !closed {
+							logger.Info("Continuing bill workflow as new", "id", workflow.GetInfo(ctx).WorkflowExecution.ID, "lineItems", len(b.LineItems))
+							return b, workflow.NewContinueAsNewError(ctx, BillWorkflow, b)
+					}
+			}
+	}
+
+	settle()
+
+	// Closed bills keep charging late fees until none are left to fall due. Line items signalled
+	// meanwhile are rejected, voids and repeated closes are ignored.
+	for accruing && b.AccruesLateFees() {
+			if shouldContinueAsNew(ctx, 0) {
+					settle()
+					logger.Info("Continuing closed bill workflow as new", "id", workflow.GetInfo(ctx).WorkflowExecution.ID, "lateFees", b.LateFees)
+					return b, workflow.NewContinueAsNewError(ctx, BillWorkflow, b)
+			}
+
+			selector := workflow.NewSelector(ctx)
+			awaitLateFees(selector)
+			selector.AddReceive(addLineItemChan, func(c workflow.ReceiveChannel, more bool) {
+					rejectBuffered()
+			})
+			selector.AddReceive(voidLineItemChan, func(c workflow.ReceiveChannel, more bool) {
+					rejectBuffered()
+			})
+			selector.AddReceive(closeChan, func(c workflow.ReceiveChannel, more bool) {
+					var signal CloseBillSignal
+					c.Receive(ctx, &signal)
+					logger.Warn("Ignored close on closed bill", "actor", signal.Actor.Principal)
+			})
+			selector.Select(ctx)
+			project()
+			index()
+			recordEvents()
+	}
 
-			if closed {
-					break
+	if archived {
+			var a *Activities
+			archiveCtx := workflow.WithActivityOptions(ctx, archiveOptions)
+			err := workflow.ExecuteActivity(archiveCtx, a.ArchiveBill, b).Get(ctx, nil)
+			if err != nil {
+					logger.Error("Error archiving bill", "error", err)
 			}
 	}
+	settle()
 
-	rlog.Info("Bill workflow completed", "id", workflow.GetInfo(ctx).WorkflowExecution.ID)
+	logger.Info("Bill workflow completed", "id", workflow.GetInfo(ctx).WorkflowExecution.ID)
 	return b, nil
 }
 
+func shouldContinueAsNew(ctx workflow.Context, itemsThisRun int) bool {
+	info := workflow.GetInfo(ctx)
+	return info.GetContinueAsNewSuggested() ||
+		info.GetCurrentHistoryLength() >= MaxHistoryLength ||
+		itemsThisRun >= MaxLineItemsPerRun
+}
+
 func (bill *Bill) AddLineItem(item LineItem) {
 	bill.LineItems = append(bill.LineItems, item)
-	bill.TotalAmount += math.Ceil(item.Amount*100) / 100 // Round to 2 dp
+	bill.TotalAmount += roundToCents(item.Amount)
+	bill.Version++
+}
+
+// VoidLineItem voids the line item, returning it as voided. Items already voided are left as they are.
+func (bill *Bill) VoidLineItem(itemId string, reason string, at time.Time) (LineItem, bool) {
+	for i := range bill.LineItems {
+		item := &bill.LineItems[i]
+		if item.Id != itemId || item.VoidedAt != nil {
+			continue
+		}
+		item.VoidedAt = &at
+		item.VoidReason = reason
+		bill.TotalAmount = roundToCents(bill.TotalAmount - roundToCents(item.Amount))
+		bill.Version++
+		return *item, true
+	}
+	return LineItem{}, false
+}
+
+// LineItemCount counts the line items that are not voided
+func (bill *Bill) LineItemCount() int {
+	count := 0
+	for _, item := range bill.LineItems {
+		if item.VoidedAt == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// IsRejected reports whether the line item was rejected because the bill was closed
+func (bill *Bill) IsRejected(itemId string) bool {
+	for _, item := range bill.RejectedItems {
+		if item.Id == itemId {
+			return true
+		}
+	}
+	return false
+}
+
+func roundToCents(amount float64) float64 {
+	return math.Ceil(amount*100) / 100 // Round to 2 dp
 } 
\ No newline at end of file
@@ -1,25 +1,59 @@
 package workflow
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
 )
 
 type UnitTestSuite struct {
 	suite.Suite
 	testsuite.WorkflowTestSuite
 	env *testsuite.TestWorkflowEnvironment
+	store *fakeBillStore
 }
 
+type fakeBillStore struct {
+	bills    map[string]Bill
+	saves    int
+	archived map[string]Bill
+	events   []BillEvent
+}
+
+func (f *fakeBillStore) SaveBill(ctx context.Context, bill Bill) error {
+	f.bills[bill.Id] = bill
+	f.saves++
+	return nil
+}
+
+func (f *fakeBillStore) AppendEvents(ctx context.Context, events []BillEvent) error {
+	f.events = append(f.events, events...)
+	return nil
+}
+
+func (f *fakeBillStore) ArchiveBill(ctx context.Context, bill Bill) error {
+	f.archived[bill.Id] = bill
+	return nil
+}
+
+const defaultTestWorkflowID = "default-test-workflow-id"
+
 func TestUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(UnitTestSuite))
 }
 
 func (s *UnitTestSuite) SetupTest() {
 	s.env = s.NewTestWorkflowEnvironment()
+	s.store = &fakeBillStore{bills: make(map[string]Bill), archived: make(map[string]Bill)}
+	s.env.RegisterActivity(&Activities{Store: s.store, Archive: s.store, Ledger: s.store})
 }
 
 func (s *UnitTestSuite) AfterTest(suiteName, testName string) {
@@ -158,4 +192,718 @@ func (s *UnitTestSuite) Test_BillCloseWithLineItem() {
 	}, time.Millisecond * 4)
 
 	s.env.ExecuteWorkflow(BillWorkflow, bill)
-}
\ No newline at end of file
+}
+
+func (s *UnitTestSuite) Test_BillLateFees() {
+	due := s.env.Now().Add(24 * time.Hour)
+
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+		DueDate: &due,
+		LateFeePolicy: &LateFeePolicy{
+			FlatFee: 5.0,
+			GraceDays: 2,
+			InterestRate: 0.01,
+			InterestPeriod: InterestDaily,
+			MaxInterest: 2.5,
+		},
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item1",
+			Amount:      100.0,
+		})
+	}, time.Millisecond)
+
+	// A day overdue, only interest has accrued
+	s.env.RegisterDelayedCallback(func() {
+		res, err := s.env.QueryWorkflow(GetBill)
+		s.NoError(err)
+		err = res.Get(&bill)
+		s.NoError(err)
+		s.Equal(2, len(bill.LineItems))
+		s.Equal(LineItemInterest, bill.LineItems[1].Type)
+		s.Equal(1.0, bill.LineItems[1].Amount)
+		s.Equal(101.0, bill.TotalAmount)
+		s.False(bill.LateFees.FlatFeeCharged)
+	}, 24*time.Hour + 24*time.Hour + time.Hour)
+
+	// Flat fee charged after the grace period and interest capped
+	s.env.RegisterDelayedCallback(func() {
+		res, err := s.env.QueryWorkflow(GetBill)
+		s.NoError(err)
+		err = res.Get(&bill)
+		s.NoError(err)
+		s.True(bill.LateFees.FlatFeeCharged)
+		s.Equal(2.5, bill.LateFees.InterestCharged)
+		s.Equal(LineItemLateFee, bill.LineItems[2].Type)
+		s.Equal(5.0, bill.LineItems[2].Amount)
+		s.Equal(107.5, bill.TotalAmount)
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, 24*time.Hour + 10*24*time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+}
+
+func (s *UnitTestSuite) Test_BillLateFeesOverdueOnCreation() {
+	due := s.env.Now().AddDate(0, -3, 0)
+
+	bill := Bill{
+		LineItems: []LineItem{{Description: "item1", Amount: 200.0, Type: LineItemFee}},
+		Currency:  "GEL",
+		TotalAmount: 200.0,
+		DueDate: &due,
+		LateFeePolicy: &LateFeePolicy{
+			InterestRate: 0.02,
+			InterestPeriod: InterestMonthly,
+			MaxInterest: 100.0,
+		},
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		res, err := s.env.QueryWorkflow(GetBill)
+		s.NoError(err)
+		err = res.Get(&bill)
+		s.NoError(err)
+		s.Equal(3, bill.LateFees.InterestPeriods)
+		s.Equal(12.0, bill.LateFees.InterestCharged)
+		s.Equal(212.0, bill.TotalAmount)
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	s.NoError(s.env.GetWorkflowResult(&bill))
+	s.Equal(100.0, bill.LateFees.InterestCharged)
+
+	// Each interest charge records the period it charged, the closed bill is charged until the interest is capped
+	periods := make([]int, 0)
+	for _, event := range s.store.events {
+		if event.Item != nil && event.Item.Type == LineItemInterest {
+			periods = append(periods, event.InterestPeriod)
+		}
+	}
+	s.Len(periods, 25)
+	for i, period := range periods {
+		s.Equal(i+1, period)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillLateFeesAfterClose() {
+	due := s.env.Now().Add(24 * time.Hour)
+
+	bill := Bill{
+		LineItems:   []LineItem{{Id: "item1", Description: "item1", Amount: 100.0, Type: LineItemFee}},
+		Currency:    "USD",
+		TotalAmount: 100.0,
+		DueDate:     &due,
+		LateFeePolicy: &LateFeePolicy{
+			FlatFee:   5.0,
+			GraceDays: 2,
+		},
+	}
+
+	// The bill is closed before it is due, and a line item reaches it while it waits for the late fee
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item2", Description: "item2", Amount: 10.0})
+	}, 2*time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		res, err := s.env.QueryWorkflow(GetBill)
+		s.NoError(err)
+		var closed Bill
+		s.NoError(res.Get(&closed))
+		s.NotNil(closed.ClosedOn)
+		s.True(closed.IsRejected("item2"))
+		s.Equal(100.0, closed.TotalAmount)
+	}, 24*time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowResult(&bill))
+
+	// The late fee is charged once the grace period has passed, then the bill completes
+	s.True(bill.LateFees.FlatFeeCharged)
+	s.Equal(105.0, bill.TotalAmount)
+	s.Equal(LineItemLateFee, bill.LineItems[1].Type)
+	s.True(due.AddDate(0, 0, 2).Equal(*bill.LineItems[1].CreatedAt))
+
+	// The charge is saved like any other change, and the bill archived with it
+	s.Equal(105.0, s.store.bills[defaultTestWorkflowID].TotalAmount)
+	s.Equal(105.0, s.store.archived[defaultTestWorkflowID].TotalAmount)
+	last := s.store.events[len(s.store.events)-1]
+	s.Equal(EventItemAdded, last.Type)
+	s.Equal("late-fee", last.Item.Id)
+	s.Equal(bill.Version, last.Sequence)
+}
+
+func (s *UnitTestSuite) Test_BillApplyEvents_SkippedInterestPeriods() {
+	due := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	bill := Bill{
+		Id:       "1234",
+		Currency: "USD",
+		DueDate:  &due,
+		LateFeePolicy: &LateFeePolicy{
+			InterestRate:   0.01,
+			InterestPeriod: InterestDaily,
+			MaxInterest:    10.0,
+		},
+	}
+	created := bill
+	events := []BillEvent{{BillId: "1234", Sequence: 0, Type: EventCreated, Bill: &created}}
+
+	// Nothing is charged for the first two periods, there are no fees yet
+	s.Empty(bill.ApplyLateFees(due.AddDate(0, 0, 2)))
+	s.Equal(2, bill.LateFees.InterestPeriods)
+
+	fee := LineItem{Id: "a", Description: "Licence", Amount: 100.0, Type: LineItemFee}
+	bill.AddLineItem(fee)
+	events = append(events, BillEvent{BillId: "1234", Sequence: bill.Version, Type: EventItemAdded, Item: &fee})
+
+	charges := bill.ApplyLateFees(due.AddDate(0, 0, 3))
+	s.Len(charges, 1)
+	s.Equal(3, charges[0].InterestPeriod)
+	s.Equal("interest-3", charges[0].Item.Id)
+	events = append(events, BillEvent{BillId: "1234", Sequence: bill.Version, Type: EventItemAdded, Item: &charges[0].Item, InterestPeriod: 3})
+
+	var folded Bill
+	for _, event := range events {
+		folded.Apply(event)
+	}
+	s.Equal(bill.LateFees, folded.LateFees)
+	s.Equal(bill.TotalAmount, folded.TotalAmount)
+
+	// Events recorded without the period fall back to the period in the item id
+	events[2].InterestPeriod = 0
+	folded = Bill{}
+	for _, event := range events {
+		folded.Apply(event)
+	}
+	s.Equal(3, folded.LateFees.InterestPeriods)
+}
+
+func (s *UnitTestSuite) Test_BillContinueAsNew() {
+	defer func(max int) { MaxLineItemsPerRun = max }(MaxLineItemsPerRun)
+	MaxLineItemsPerRun = 2
+
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item1",
+			Amount:      10.0,
+		})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item2",
+			Amount:      11.0,
+		})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item3",
+			Amount:      12.0,
+		})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+
+	// The pending signal is applied before the state is carried over to the next run
+	var canErr *workflow.ContinueAsNewError
+	s.True(errors.As(s.env.GetWorkflowError(), &canErr))
+
+	var next Bill
+	s.NoError(converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &next))
+	s.Equal(3, len(next.LineItems))
+	s.Equal(33.0, next.TotalAmount)
+	s.Equal("item3", next.LineItems[2].Description)
+}
+
+func (s *UnitTestSuite) Test_BillContinueAsNewClosed() {
+	defer func(max int) { MaxLineItemsPerRun = max }(MaxLineItemsPerRun)
+	MaxLineItemsPerRun = 2
+
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+	}
+
+	var upserts []temporal.SearchAttributes
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Run(func(args mock.Arguments) {
+		upserts = append(upserts, args.Get(0).(temporal.SearchAttributes))
+	}).Return(nil)
+
+	// Each projection takes a minute, the close arrives while the second item is projected
+	// and is only received when the bill is about to continue as new
+	s.env.OnActivity("ProjectBill", mock.Anything, mock.Anything).After(time.Minute).Return(func(ctx context.Context, b Bill) error {
+		return s.store.SaveBill(ctx, b)
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Description: "item1", Amount: 10.0})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Description: "item2", Amount: 11.0})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, 150*time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowResult(&bill))
+	s.NotNil(bill.ClosedOn)
+
+	// The read model and search attributes show the bill closed
+	s.NotNil(s.store.bills[defaultTestWorkflowID].ClosedOn)
+	status, _ := upserts[len(upserts)-1].GetKeyword(StatusKey)
+	s.Equal(StatusClosed, status)
+}
+
+func (s *UnitTestSuite) Test_BillCloseRejectsPendingLineItems() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Id:          "1",
+			Description: "item1",
+			Amount:      10.0,
+		})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Id:          "2",
+			Description: "item2",
+			Amount:      11.0,
+		})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	s.NoError(s.env.GetWorkflowResult(&bill))
+	s.NotNil(bill.ClosedOn)
+	s.Equal(0, len(bill.LineItems))
+	s.Equal(0.0, bill.TotalAmount)
+	s.Equal(2, len(bill.RejectedItems))
+	s.Equal("bill is closed", bill.RejectedItems[0].Reason)
+	s.True(bill.IsRejected("1"))
+	s.True(bill.IsRejected("2"))
+}
+
+func (s *UnitTestSuite) Test_BillCloseRejectsLineItemsWhileSaving() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+	}
+
+	// The item arrives while the closed bill is being archived
+	s.env.OnActivity("ArchiveBill", mock.Anything, mock.Anything).After(time.Hour).Return(nil)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Id:          "1",
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	s.NoError(s.env.GetWorkflowResult(&bill))
+	s.True(bill.IsRejected("1"))
+
+	// The rejection is saved like any other change
+	projected := s.store.bills[defaultTestWorkflowID]
+	s.True(projected.IsRejected("1"))
+	last := s.store.events[len(s.store.events)-1]
+	s.Equal(EventItemRejected, last.Type)
+	s.Equal(bill.Version, last.Sequence)
+}
+
+func (s *UnitTestSuite) Test_BillProjection() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		TotalAmount: 0.0,
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		projected := s.store.bills[defaultTestWorkflowID]
+		s.Equal(1, len(projected.LineItems))
+		s.Nil(projected.ClosedOn)
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 2)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	// Projected on creation, after the line item and on close
+	s.Equal(3, s.store.saves)
+	projected := s.store.bills[defaultTestWorkflowID]
+	s.Equal(defaultTestWorkflowID, projected.Id)
+	s.Equal(10.0, projected.TotalAmount)
+	s.NotNil(projected.ClosedOn)
+	s.Equal(2, projected.Version)
+
+	// Archived once closed
+	archived := s.store.archived[defaultTestWorkflowID]
+	s.NotNil(archived.ClosedOn)
+	s.Equal(10.0, archived.TotalAmount)
+}
+
+func (s *UnitTestSuite) Test_BillSearchAttributes() {
+	bill := Bill{
+		LineItems:  make([]LineItem, 0),
+		Currency:   "GEL",
+		CustomerId: "acme",
+		TenantId:   "tenant1",
+	}
+
+	var upserts []temporal.SearchAttributes
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Run(func(args mock.Arguments) {
+		upserts = append(upserts, args.Get(0).(temporal.SearchAttributes))
+	}).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 2)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	// Indexed on creation, after the line item and on close
+	s.Len(upserts, 3)
+
+	created, _ := upserts[0].GetKeyword(StatusKey)
+	s.Equal(StatusOpen, created)
+	customer, _ := upserts[0].GetKeyword(CustomerIdKey)
+	s.Equal("acme", customer)
+	tenant, _ := upserts[0].GetKeyword(TenantIdKey)
+	s.Equal("tenant1", tenant)
+	s.False(upserts[0].ContainsKey(ClosedOnKey))
+
+	items, _ := upserts[1].GetInt64(LineItemCountKey)
+	s.Equal(int64(1), items)
+	total, _ := upserts[1].GetFloat64(TotalAmountKey)
+	s.Equal(10.0, total)
+
+	closed, _ := upserts[2].GetKeyword(StatusKey)
+	s.Equal(StatusClosed, closed)
+	s.True(upserts[2].ContainsKey(ClosedOnKey))
+}
+
+func (s *UnitTestSuite) Test_BillSearchAttributes_SkipsVoidedItems() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	var upserts []temporal.SearchAttributes
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Run(func(args mock.Arguments) {
+		upserts = append(upserts, args.Get(0).(temporal.SearchAttributes))
+	}).Return(nil)
+	var summaries []BillSummary
+	s.env.OnUpsertMemo(mock.Anything).Run(func(args mock.Arguments) {
+		summaries = append(summaries, args.Get(0).(map[string]interface{})[SummaryMemoKey].(BillSummary))
+	}).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item1", Description: "item1", Amount: 10.0})
+	}, time.Millisecond)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item2", Description: "item2", Amount: 5.0})
+	}, time.Millisecond * 2)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "item1", Reason: "duplicate"})
+	}, time.Millisecond * 3)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 4)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	// The voided item stays on the bill but is no longer counted
+	voided := upserts[len(upserts)-2]
+	items, _ := voided.GetInt64(LineItemCountKey)
+	s.Equal(int64(1), items)
+	total, _ := voided.GetFloat64(TotalAmountKey)
+	s.Equal(5.0, total)
+	s.Equal(BillSummary{Currency: "USD", TotalAmount: 5.0, LineItemCount: 1, Status: StatusClosed}, summaries[len(summaries)-1])
+}
+
+func (s *UnitTestSuite) Test_BillSummaryMemo() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	var summaries []BillSummary
+	s.env.OnUpsertMemo(mock.Anything).Run(func(args mock.Arguments) {
+		summaries = append(summaries, args.Get(0).(map[string]interface{})[SummaryMemoKey].(BillSummary))
+	}).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 2)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	s.Equal([]BillSummary{
+		{Currency: "USD", TotalAmount: 0, LineItemCount: 0, Status: StatusOpen},
+		{Currency: "USD", TotalAmount: 10.0, LineItemCount: 1, Status: StatusOpen},
+		{Currency: "USD", TotalAmount: 10.0, LineItemCount: 1, Status: StatusClosed},
+	}, summaries)
+}
+
+func (s *UnitTestSuite) Test_BillLedger() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Id:          "item1",
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 2)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	events := s.store.events
+	s.Len(events, 3)
+
+	s.Equal(EventCreated, events[0].Type)
+	s.Equal(0, events[0].Sequence)
+	s.Equal("USD", events[0].Bill.Currency)
+
+	s.Equal(EventItemAdded, events[1].Type)
+	s.Equal(1, events[1].Sequence)
+	s.Equal("item1", events[1].Item.Id)
+
+	s.Equal(EventClosed, events[2].Type)
+	s.Equal(2, events[2].Sequence)
+
+	for _, event := range events {
+		s.Equal(defaultTestWorkflowID, event.BillId)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillLedgerActors() {
+	creator := Actor{Principal: "key1", ClientIp: "203.0.113.7", RequestId: "req1"}
+	biller := Actor{Principal: "key2", ClientIp: "203.0.113.8", RequestId: "req2"}
+	approver := Actor{Principal: "key3", ClientIp: "203.0.113.9", RequestId: "req3"}
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+		CreatedBy: &creator,
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item1", Description: "item1", Amount: 10.0, Actor: biller})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "item1", Reason: "charged twice", Actor: approver})
+	}, time.Millisecond*2)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{Actor: approver})
+	}, time.Millisecond*3)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	events := s.store.events
+	s.Len(events, 4)
+	s.Equal(creator, *events[0].Actor)
+	s.Equal(biller, *events[1].Actor)
+	s.Equal(EventItemVoided, events[2].Type)
+	s.Equal(approver, *events[2].Actor)
+	s.Equal(EventClosed, events[3].Type)
+	s.Equal(approver, *events[3].Actor)
+}
+
+func (s *UnitTestSuite) Test_BillLedgerRejectedItems() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{
+			Id:          "item1",
+			Description: "item1",
+			Amount:      10.0,
+		})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	events := s.store.events
+	s.Len(events, 3)
+	s.Equal(EventClosed, events[1].Type)
+	s.Equal(1, events[1].Sequence)
+	s.Equal(EventItemRejected, events[2].Type)
+	s.Equal(2, events[2].Sequence)
+	s.Equal("item1", events[2].Item.Id)
+	s.Equal("bill is closed", events[2].Reason)
+}
+
+func (s *UnitTestSuite) Test_BillLedgerKeepsEventsNotRecorded() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	// The creation fails without retrying and is recorded with the next change
+	s.env.OnActivity("RecordBillEvents", mock.Anything, mock.Anything).Return(temporal.NewNonRetryableApplicationError("ledger unavailable", "Unavailable", nil)).Once()
+	s.env.OnActivity("RecordBillEvents", mock.Anything, mock.Anything).Return(func(ctx context.Context, events []BillEvent) error {
+		return s.store.AppendEvents(ctx, events)
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	events := s.store.events
+	s.Len(events, 2)
+	s.Equal(EventCreated, events[0].Type)
+	s.Equal(0, events[0].Sequence)
+	s.Equal(EventClosed, events[1].Type)
+	s.Equal(1, events[1].Sequence)
+}
+
+func (s *UnitTestSuite) Test_VoidLineItem() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "USD",
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item1", Description: "item1", Amount: 10.0})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item2", Description: "item2", Amount: 2.5})
+	}, time.Millisecond * 2)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "item1", Reason: "charged twice"})
+	}, time.Millisecond * 3)
+
+	// Voiding an item twice, or an item the bill does not have, changes nothing
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "item1"})
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "unknown"})
+	}, time.Millisecond * 4)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 5)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	var result Bill
+	s.NoError(s.env.GetWorkflowResult(&result))
+	s.Equal(2.5, result.TotalAmount)
+	s.Len(result.LineItems, 2)
+	s.NotNil(result.LineItems[0].VoidedAt)
+	s.Equal("charged twice", result.LineItems[0].VoidReason)
+	s.Nil(result.LineItems[1].VoidedAt)
+	s.Equal(4, result.Version)
+
+	events := s.store.events
+	s.Len(events, 5)
+	s.Equal(EventItemVoided, events[3].Type)
+	s.Equal(3, events[3].Sequence)
+	s.Equal("item1", events[3].Item.Id)
+	s.Equal("charged twice", events[3].Reason)
+}
+
+func (s *UnitTestSuite) Test_BillApplyEvents() {
+	bill := Bill{
+		LineItems: make([]LineItem, 0),
+		Currency:  "GEL",
+		CustomerId: "customer1",
+	}
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(AddLineItem, AddLineItemSignal{Id: "item1", Description: "item1", Amount: 10.0})
+	}, time.Millisecond)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(VoidLineItem, VoidLineItemSignal{ItemId: "item1", Reason: "charged twice"})
+	}, time.Millisecond * 2)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(CloseBill, CloseBillSignal{})
+	}, time.Millisecond * 3)
+
+	s.env.ExecuteWorkflow(BillWorkflow, bill)
+	s.True(s.env.IsWorkflowCompleted())
+
+	var result Bill
+	s.NoError(s.env.GetWorkflowResult(&result))
+
+	// Folding the ledger rebuilds the bill at every version
+	var folded Bill
+	for i, event := range s.store.events {
+		folded.Apply(event)
+		s.Equal(i, folded.Version)
+	}
+	s.Equal(result.TotalAmount, folded.TotalAmount)
+	s.Equal(result.CustomerId, folded.CustomerId)
+	s.Len(folded.LineItems, 1)
+	s.NotNil(folded.LineItems[0].VoidedAt)
+	s.NotNil(folded.ClosedOn)
+	s.Equal(result.Version, folded.Version)
+}